@@ -5,8 +5,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/cloudflare-go"
@@ -14,16 +18,61 @@ import (
 	"github.com/mholt/acmez/acme"
 )
 
-type dns01Solver struct {
-	api    *cloudflare.API
-	zone   string
-	record string
+// DNS01Solver is an acmez.Solver that solves DNS-01 challenges
+// using Cloudflare's Authoritative DNS.
+//
+// Configure a DNS01Solver by setting its fields before using it.
+type DNS01Solver struct {
+	// PropagationChecker reports whether a TXT record with the given name and value
+	// is visible to the ACME server; Wait polls it until it returns true.
+	// If nil, Google Public DNS is queried.
+	//
+	// In split-horizon setups, this can query Cloudflare's authoritative nameservers directly.
+	PropagationChecker func(ctx context.Context, name, value string) (bool, error)
+
+	// CreateRecord and DeleteRecord, if both set, replace the Cloudflare API calls
+	// that create and delete the TXT record with the given name and value.
+	//
+	// With Cloudflare for SaaS, custom hostnames can delegate their challenges
+	// with a CNAME to a record in the SaaS provider's zone;
+	// these can map the name, and create the record in that zone
+	// (or through whatever API the setup requires).
+	// A DNS01Solver with these set needs no zone or API token:
+	//
+	//	solver := &acmecf.DNS01Solver{CreateRecord: create, DeleteRecord: remove}
+	CreateRecord func(ctx context.Context, name, value string) (id string, err error)
+	DeleteRecord func(ctx context.Context, id string) error
+
+	// Batch, if set, makes Present queue TXT records,
+	// which are created concurrently on the next call to Wait.
+	// acmez presents all of an order's challenges before waiting for any,
+	// so this speeds up issuance of certificates for many names.
+	Batch bool
+
+	// RecordName, if set, maps the name of TXT records
+	// (e.g. _acme-challenge.www.example.com) to the name to create in the zone,
+	// e.g. a name under a zone delegated with a CNAME.
+	// Propagation is still checked for the original name.
+	// Ignored when CreateRecord is set.
+	RecordName func(name string) string
+
+	// TTL, if set, is the TTL of TXT records, in seconds (1 means automatic).
+	// Short TTLs make changes visible sooner.
+	// Ignored when CreateRecord is set.
+	TTL int
+
+	api     *cloudflare.API
+	zone    string
+	mutex   sync.Mutex
+	records map[string]string
+	pending []acme.Challenge
+	errors  map[string]error
 }
 
 // NewDNS01Solver creates an acmez.Solver that solves DNS-01 challenges
 // using Cloudflare's Authoritative DNS, given the zone ID and a token
 // with Zone.DNS permission.
-func NewDNS01Solver(zone, token string) (acmez.Solver, error) {
+func NewDNS01Solver(zone, token string) (*DNS01Solver, error) {
 	api, err := cloudflare.NewWithAPIToken(token)
 	if err != nil {
 		return nil, err
@@ -33,45 +82,219 @@ func NewDNS01Solver(zone, token string) (acmez.Solver, error) {
 
 // NewDNS01SolverWithClient creates an acmez.Solver that solves DNS-01 challenges
 // using Cloudflare's Authoritative DNS, given an API instance and zone ID.
-func NewDNS01SolverWithClient(api *cloudflare.API, zone string) acmez.Solver {
-	return &dns01Solver{
+func NewDNS01SolverWithClient(api *cloudflare.API, zone string) *DNS01Solver {
+	return &DNS01Solver{
 		api:  api,
 		zone: zone,
 	}
 }
 
-func (s *dns01Solver) Present(ctx context.Context, chal acme.Challenge) error {
+// Errors returned by DNS01Solver, for errors.Is.
+var (
+	ErrUnexpectedChallenge = errors.New("unexpected challenge") // not a DNS-01 challenge
+	ErrPropagationTimeout  = errors.New("timeout")              // the TXT record never became visible
+)
+
+var _ acmez.Solver = &DNS01Solver{}
+var _ acmez.Waiter = &DNS01Solver{}
+
+// Present creates the TXT record for a DNS-01 challenge.
+func (s *DNS01Solver) Present(ctx context.Context, chal acme.Challenge) error {
 	if chal.Type != acme.ChallengeTypeDNS01 {
-		return errors.New("unexpected challenge")
+		return ErrUnexpectedChallenge
+	}
+	if s.Batch {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.pending = append(s.pending, chal)
+		return nil
+	}
+	return s.present(ctx, chal)
+}
+
+// PresentAll creates the TXT records for several DNS-01 challenges concurrently.
+func (s *DNS01Solver) PresentAll(ctx context.Context, chals ...acme.Challenge) error {
+	return errors.Join(s.presentAll(ctx, chals)...)
+}
+
+func (s *DNS01Solver) presentAll(ctx context.Context, chals []acme.Challenge) []error {
+	errs := make([]error, len(chals))
+	sema := make(chan struct{}, 8)
+
+	var wg sync.WaitGroup
+	for i := range chals {
+		if chals[i].Type != acme.ChallengeTypeDNS01 {
+			errs[i] = ErrUnexpectedChallenge
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sema <- struct{}{}
+			defer func() { <-sema }()
+			errs[i] = s.present(ctx, chals[i])
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// flush creates the records queued by Present,
+// and remembers their errors for Wait.
+func (s *DNS01Solver) flush(ctx context.Context) {
+	s.mutex.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	errs := s.presentAll(ctx, pending)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, err := range errs {
+		if err != nil {
+			if s.errors == nil {
+				s.errors = map[string]error{}
+			}
+			s.errors[recordKey(pending[i])] = err
+		}
 	}
+}
 
+// batchError returns (and forgets) the error creating a queued record.
+func (s *DNS01Solver) batchError(chal acme.Challenge) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.errors[recordKey(chal)]
+	delete(s.errors, recordKey(chal))
+	return err
+}
+
+func (s *DNS01Solver) present(ctx context.Context, chal acme.Challenge) error {
 	rec := cloudflare.CreateDNSRecordParams{
 		Type:    "TXT",
-		Name:    chal.DNS01TXTRecordName(),
+		Name:    recordName(chal),
 		Content: chal.DNS01KeyAuthorization(),
+		TTL:     s.TTL,
+	}
+
+	if s.pluggable() {
+		id, err := s.CreateRecord(ctx, rec.Name, rec.Content)
+		if err != nil {
+			return &PresentError{
+				Zone:  s.zone,
+				Name:  rec.Name,
+				Value: rec.Content,
+				Err:   err,
+			}
+		}
+		s.setRecordID(chal, id)
+		return nil
+	}
+
+	if s.RecordName != nil {
+		rec.Name = s.RecordName(rec.Name)
 	}
 
 	zone := cloudflare.ZoneIdentifier(s.zone)
-	res, err := s.api.CreateDNSRecord(ctx, zone, rec)
+	res, err := s.createRecord(ctx, zone, rec)
 	if err != nil {
-		res, _, _ := s.api.ListDNSRecords(ctx, zone, cloudflare.ListDNSRecordsParams{
+		// maybe the record already exists
+		res, _, lerr := s.api.ListDNSRecords(ctx, zone, cloudflare.ListDNSRecordsParams{
 			Type:    "TXT",
-			Name:    chal.DNS01TXTRecordName(),
-			Content: chal.DNS01KeyAuthorization(),
+			Name:    rec.Name,
+			Content: rec.Content,
 		})
-		if len(res) == 1 {
-			s.record = res[0].ID
+		if lerr == nil && len(res) == 1 {
+			s.setRecordID(chal, res[0].ID)
 			return nil
 		}
-		return err
+		return &PresentError{
+			Zone:    s.zone,
+			Name:    rec.Name,
+			Value:   rec.Content,
+			Err:     err,
+			ListErr: lerr,
+		}
 	}
 
-	s.record = res.ID
+	s.setRecordID(chal, res.ID)
 	return nil
 }
 
-func (s *dns01Solver) Wait(ctx context.Context, challenge acme.Challenge) error {
-	if s.record == "" {
+// createRecord creates rec, retrying timeouts with backoff.
+func (s *DNS01Solver) createRecord(ctx context.Context, zone *cloudflare.ResourceContainer, rec cloudflare.CreateDNSRecordParams) (cloudflare.DNSRecord, error) {
+	backoff := retryDelay
+	for i := 1; ; i++ {
+		res, err := s.api.CreateDNSRecord(ctx, zone, rec)
+		if err == nil || i >= createAttempts || !retryable(ctx, err) {
+			return res, err
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return res, err
+		}
+	}
+}
+
+const createAttempts = 3
+
+var retryDelay = time.Second
+
+// retryable reports whether err is a timeout, and ctx isn't done.
+// The client's RetryPolicy already retries rate limits, server errors,
+// and other network errors, but gives up on timeouts.
+func retryable(ctx context.Context, err error) bool {
+	var nerr net.Error
+	return ctx.Err() == nil && errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// RecordID returns the ID of the TXT record created (or found to already exist) by Present,
+// or an empty string if there is none.
+func (s *DNS01Solver) RecordID(chal acme.Challenge) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.records[recordKey(chal)]
+}
+
+func (s *DNS01Solver) setRecordID(chal acme.Challenge, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id == "" {
+		delete(s.records, recordKey(chal))
+		return
+	}
+	if s.records == nil {
+		s.records = map[string]string{}
+	}
+	s.records[recordKey(chal)] = id
+}
+
+// recordKey identifies the TXT record of a challenge by name and value:
+// example.com and *.example.com share a name, with different values.
+func recordKey(chal acme.Challenge) string {
+	return recordName(chal) + " " + chal.DNS01KeyAuthorization()
+}
+
+// recordName is the name of the TXT record for a challenge.
+// Wildcard identifiers are validated at the base domain (RFC 8555, section 8.4),
+// and ACME servers drop the wildcard; this also tolerates identifiers that keep it.
+func recordName(chal acme.Challenge) string {
+	return "_acme-challenge." + strings.TrimPrefix(chal.Identifier.Value, "*.")
+}
+
+// Wait waits for the TXT record to propagate.
+func (s *DNS01Solver) Wait(ctx context.Context, challenge acme.Challenge) error {
+	s.flush(ctx)
+	if err := s.batchError(challenge); err != nil {
+		return err
+	}
+	if s.RecordID(challenge) == "" {
 		return nil
 	}
 
@@ -83,26 +306,67 @@ func (s *dns01Solver) Wait(ctx context.Context, challenge acme.Challenge) error
 			return ctx.Err()
 		}
 
-		recs, err := lookupTXT(ctx, challenge.DNS01TXTRecordName())
-		if err != nil {
-			continue
+		ok, err := s.propagated(ctx, recordName(challenge), challenge.DNS01KeyAuthorization())
+		if err == nil && ok {
+			return nil
 		}
+	}
+	return ErrPropagationTimeout
+}
 
-		for _, rec := range recs {
-			if rec == challenge.DNS01KeyAuthorization() {
-				return nil
-			}
+// CleanUp deletes the TXT record.
+func (s *DNS01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	s.dequeue(chal)
+	s.batchError(chal)
+
+	id := s.RecordID(chal)
+	if id == "" {
+		return nil
+	}
+	var err error
+	if s.pluggable() {
+		err = s.DeleteRecord(ctx, id)
+	} else {
+		err = s.api.DeleteDNSRecord(ctx, cloudflare.ZoneIdentifier(s.zone), id)
+	}
+	if err == nil {
+		s.setRecordID(chal, "")
+	}
+	return err
+}
+
+// dequeue removes a record queued by Present, that was never created.
+func (s *DNS01Solver) dequeue(chal acme.Challenge) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := recordKey(chal)
+	for i := range s.pending {
+		if recordKey(s.pending[i]) == key {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
 		}
 	}
-	return errors.New("timeout")
 }
 
-func (s *dns01Solver) CleanUp(ctx context.Context, chal acme.Challenge) error {
-	if s.record == "" {
-		return nil
+func (s *DNS01Solver) pluggable() bool {
+	return s.CreateRecord != nil && s.DeleteRecord != nil
+}
+
+func (s *DNS01Solver) propagated(ctx context.Context, name, value string) (bool, error) {
+	if s.PropagationChecker != nil {
+		return s.PropagationChecker(ctx, name, value)
 	}
-	zone := cloudflare.ZoneIdentifier(s.zone)
-	return s.api.DeleteDNSRecord(ctx, zone, s.record)
+
+	recs, err := lookupTXT(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	for _, rec := range recs {
+		if rec == value {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func lookupTXT(ctx context.Context, domain string) ([]string, error) {
@@ -135,8 +399,8 @@ func lookupTXT(ctx context.Context, domain string) ([]string, error) {
 
 	var ret []string
 	for _, answer := range dns.Answer {
-		if len := len(answer.Data); len > 2 {
-			ret = append(ret, answer.Data[1:len-1])
+		if txt := parseTXT(answer.Data); txt != "" {
+			ret = append(ret, txt)
 		}
 	}
 	if len(ret) == 0 {
@@ -144,3 +408,59 @@ func lookupTXT(ctx context.Context, domain string) ([]string, error) {
 	}
 	return ret, nil
 }
+
+// parseTXT parses TXT record data in presentation format,
+// concatenating character-strings.
+// Records longer than 255 bytes are split into several strings:
+//
+//	"first 255 bytes" "the rest"
+func parseTXT(data string) string {
+	var buf strings.Builder
+	var quoted bool
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			// separates strings
+		case c == '\\' && i+1 < len(data):
+			i++
+			if i+2 < len(data) && isDigit(data[i]) && isDigit(data[i+1]) && isDigit(data[i+2]) {
+				n, _ := strconv.Atoi(data[i : i+3])
+				buf.WriteByte(byte(n))
+				i += 2
+			} else {
+				buf.WriteByte(data[i])
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+// A PresentError is returned by Present when it fails to create a TXT record.
+type PresentError struct {
+	Zone    string // the zone ID
+	Name    string // the name of the record
+	Value   string // the content of the record
+	Err     error  // the error creating the record
+	ListErr error  // the error looking for an existing record, if any
+}
+
+func (e *PresentError) Error() string {
+	msg := "acmecf: creating TXT record " + e.Name + " in zone " + e.Zone + ": " + e.Err.Error()
+	if e.ListErr != nil {
+		msg += "; looking for existing record: " + e.ListErr.Error()
+	}
+	return msg
+}
+
+func (e *PresentError) Unwrap() []error {
+	if e.ListErr != nil {
+		return []error{e.Err, e.ListErr}
+	}
+	return []error{e.Err}
+}
@@ -0,0 +1,414 @@
+package acmecf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/mholt/acmez/acme"
+)
+
+func Test_parseTXT(t *testing.T) {
+	tests := []struct {
+		data, want string
+	}{
+		{`"abc"`, "abc"},
+		{`"abc" "def"`, "abcdef"},
+		{`"a b" "c"`, "a bc"},
+		{`"a\"b\\c"`, `a"b\c`},
+		{`"a\032b"`, "a b"},
+		{`""`, ""},
+	}
+	for _, tt := range tests {
+		if got := parseTXT(tt.data); got != tt.want {
+			t.Errorf("parseTXT(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestDNS01Solver_pluggable(t *testing.T) {
+	records := map[string]string{}
+	solver := &DNS01Solver{
+		CreateRecord: func(ctx context.Context, name, value string) (string, error) {
+			id := strconv.Itoa(len(records) + 1)
+			records[id] = name + " " + value
+			return id, nil
+		},
+		DeleteRecord: func(ctx context.Context, id string) error {
+			delete(records, id)
+			return nil
+		},
+	}
+
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+		KeyAuthorization: "key",
+	}
+	if err := solver.Present(context.Background(), chal); err != nil {
+		t.Fatal(err)
+	}
+	if id := solver.RecordID(chal); records[id] != recordKey(chal) {
+		t.Errorf("got %q", records)
+	}
+	if err := solver.CleanUp(context.Background(), chal); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 || solver.RecordID(chal) != "" {
+		t.Errorf("got %q", records)
+	}
+}
+
+func TestDNS01Solver_Batch(t *testing.T) {
+	var mutex sync.Mutex
+	records := map[string]string{}
+	solver := &DNS01Solver{
+		Batch: true,
+		CreateRecord: func(ctx context.Context, name, value string) (string, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			id := strconv.Itoa(len(records) + 1)
+			records[id] = name + " " + value
+			return id, nil
+		},
+		DeleteRecord: func(ctx context.Context, id string) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			delete(records, id)
+			return nil
+		},
+	}
+
+	var chals []acme.Challenge
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		chal := acme.Challenge{
+			Type:             acme.ChallengeTypeDNS01,
+			Identifier:       acme.Identifier{Type: "dns", Value: name},
+			KeyAuthorization: "key",
+		}
+		if err := solver.Present(context.Background(), chal); err != nil {
+			t.Fatal(err)
+		}
+		chals = append(chals, chal)
+	}
+	if len(records) != 0 {
+		t.Fatalf("got %q", records)
+	}
+
+	// never waited for: never created
+	if err := solver.CleanUp(context.Background(), chals[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	solver.flush(context.Background())
+	if len(records) != 2 {
+		t.Fatalf("got %q", records)
+	}
+	for _, chal := range chals[:2] {
+		if err := solver.CleanUp(context.Background(), chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(records) != 0 {
+		t.Errorf("got %q", records)
+	}
+}
+
+func TestDNS01Solver_retry(t *testing.T) {
+	retryDelay = time.Millisecond
+
+	tests := []struct {
+		name  string
+		fail  func(w http.ResponseWriter)
+		calls int32
+	}{
+		// timeouts are retried
+		{"timeout", func(w http.ResponseWriter) { time.Sleep(100 * time.Millisecond) }, 2},
+		// server errors are left to the client's RetryPolicy
+		{"unavailable", func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) }, 1},
+	}
+	for _, tt := range tests {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// count creates, not the list that follows a failure
+			if r.Method == http.MethodPost && calls.Add(1) == 1 {
+				tt.fail(w)
+				return
+			}
+			io.WriteString(w, `{"success":true,"result":{"id":"rec"}}`)
+		}))
+
+		api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL),
+			cloudflare.HTTPClient(&http.Client{Timeout: 50 * time.Millisecond}),
+			cloudflare.UsingRetryPolicy(0, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		solver := NewDNS01SolverWithClient(api, "zone")
+
+		chal := acme.Challenge{Type: acme.ChallengeTypeDNS01, Identifier: acme.Identifier{Value: "example.com"}}
+		solver.Present(context.Background(), chal)
+		if n := calls.Load(); n != tt.calls {
+			t.Errorf("%s: got %d calls, want %d", tt.name, n, tt.calls)
+		}
+		srv.Close()
+	}
+
+	// never retry once ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if retryable(ctx, context.DeadlineExceeded) {
+		t.Error("retrying after ctx is done")
+	}
+}
+
+func TestDNS01Solver_RecordName(t *testing.T) {
+	var name string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec cloudflare.DNSRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		name = rec.Name
+		io.WriteString(w, `{"success":true,"result":{"id":"rec"}}`)
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver := NewDNS01SolverWithClient(api, "zone")
+	solver.RecordName = func(name string) string { return strings.Replace(name, ".example.com", ".acme.example.net", 1) }
+
+	chal := acme.Challenge{Type: acme.ChallengeTypeDNS01, Identifier: acme.Identifier{Value: "www.example.com"}}
+	if err := solver.Present(context.Background(), chal); err != nil {
+		t.Fatal(err)
+	}
+	if name != "_acme-challenge.www.acme.example.net" {
+		t.Errorf("got %q", name)
+	}
+}
+
+func TestDNS01Solver_wildcard(t *testing.T) {
+	var mutex sync.Mutex
+	records := map[string]cloudflare.DNSRecord{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.Method {
+		case http.MethodPost:
+			var rec cloudflare.DNSRecord
+			json.NewDecoder(r.Body).Decode(&rec)
+			rec.ID = "rec" + strconv.Itoa(len(records)+1)
+			records[rec.ID] = rec
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "result": rec})
+		case http.MethodDelete:
+			id := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+			delete(records, id)
+			io.WriteString(w, `{"success":true,"result":{"id":"`+id+`"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver := NewDNS01SolverWithClient(api, "zone")
+	solver.PropagationChecker = func(ctx context.Context, name, value string) (bool, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, rec := range records {
+			if rec.Name == name && rec.Content == value {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// one order for example.com and *.example.com:
+	// two challenges, the same TXT name, different values
+	var chals []acme.Challenge
+	for _, id := range []acme.Identifier{{Value: "example.com"}, {Value: "*.example.com"}} {
+		chals = append(chals, acme.Challenge{
+			Type:             acme.ChallengeTypeDNS01,
+			Identifier:       id,
+			KeyAuthorization: "key for " + id.Value,
+		})
+	}
+	for _, chal := range chals {
+		if err := solver.Present(context.Background(), chal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %v", records)
+	}
+	for _, rec := range records {
+		if rec.Name != "_acme-challenge.example.com" {
+			t.Errorf("got %q", rec.Name)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, chal := range chals {
+		wg.Add(1)
+		go func(chal acme.Challenge) {
+			defer wg.Done()
+			if err := solver.Wait(context.Background(), chal); err != nil {
+				t.Error(err)
+			}
+		}(chal)
+	}
+	wg.Wait()
+
+	// cleaning up one leaves the other
+	if err := solver.CleanUp(context.Background(), chals[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || solver.RecordID(chals[1]) == "" {
+		t.Fatalf("got %v", records)
+	}
+	for _, rec := range records {
+		if rec.Content != chals[1].DNS01KeyAuthorization() {
+			t.Errorf("got %q", rec.Content)
+		}
+	}
+	if err := solver.CleanUp(context.Background(), chals[1]); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("got %v", records)
+	}
+}
+
+func TestDNS01Solver_PropagationChecker(t *testing.T) {
+	var checked []string
+	solver := &DNS01Solver{
+		CreateRecord: func(ctx context.Context, name, value string) (string, error) { return "rec", nil },
+		DeleteRecord: func(ctx context.Context, id string) error { return nil },
+		PropagationChecker: func(ctx context.Context, name, value string) (bool, error) {
+			checked = append(checked, name+" "+value)
+			return false, nil
+		},
+	}
+
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+		KeyAuthorization: "key",
+	}
+	if err := solver.Present(context.Background(), chal); err != nil {
+		t.Fatal(err)
+	}
+
+	// never propagates: Wait polls until ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if err := solver.Wait(ctx, chal); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if len(checked) != 1 || checked[0] != recordKey(chal) {
+		t.Errorf("got %q", checked)
+	}
+}
+
+func TestDNS01Solver_PresentError(t *testing.T) {
+	var existing string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"success":false,"errors":[{"code":81057,"message":"record already exists"}]}`)
+		case existing == "":
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"success":false,"errors":[{"code":10000,"message":"forbidden"}]}`)
+		default:
+			io.WriteString(w, `{"success":true,"result":[{"id":"`+existing+`","type":"TXT"}]}`)
+		}
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL), cloudflare.UsingRateLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver := NewDNS01SolverWithClient(api, "zone")
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeDNS01,
+		Identifier:       acme.Identifier{Value: "example.com"},
+		KeyAuthorization: "key",
+	}
+
+	// creating and listing fail
+	err = solver.Present(context.Background(), chal)
+	var perr *PresentError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got %v", err)
+	}
+	if perr.Zone != "zone" || perr.Name != "_acme-challenge.example.com" || perr.Value != chal.DNS01KeyAuthorization() ||
+		perr.Err == nil || perr.ListErr == nil {
+		t.Errorf("got %+v", perr)
+	}
+	var cerr *cloudflare.Error
+	if !errors.As(err, &cerr) || cerr.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %v", err)
+	}
+	if id := solver.RecordID(chal); id != "" {
+		t.Errorf("got %q", id)
+	}
+
+	// the record already exists
+	existing = "rec"
+	if err := solver.Present(context.Background(), chal); err != nil {
+		t.Fatal(err)
+	}
+	if id := solver.RecordID(chal); id != "rec" {
+		t.Errorf("got %q", id)
+	}
+
+	// pluggable records
+	fail := errors.New("unavailable")
+	solver = &DNS01Solver{
+		CreateRecord: func(ctx context.Context, name, value string) (string, error) { return "", fail },
+		DeleteRecord: func(ctx context.Context, id string) error { return nil },
+	}
+	if err := solver.Present(context.Background(), chal); !errors.Is(err, fail) || !errors.As(err, &perr) || perr.ListErr != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDNS01Solver_TTL(t *testing.T) {
+	var ttl int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec cloudflare.DNSRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		ttl = rec.TTL
+		io.WriteString(w, `{"success":true,"result":{"id":"rec"}}`)
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver := NewDNS01SolverWithClient(api, "zone")
+	solver.TTL = 60
+
+	chal := acme.Challenge{Type: acme.ChallengeTypeDNS01, Identifier: acme.Identifier{Value: "example.com"}}
+	if err := solver.Present(context.Background(), chal); err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 60 {
+		t.Errorf("got TTL %d, want 60", ttl)
+	}
+}
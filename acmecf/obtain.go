@@ -0,0 +1,188 @@
+package acmecf
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+// LetsEncrypt is the directory URL of Let's Encrypt's production CA.
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// ObtainCertificate obtains a certificate for domains from the ACME CA at directory,
+// solving DNS-01 challenges with solver.
+//
+// The account, which must have a PrivateKey and agree to the CA's terms of service,
+// is registered with the CA if it has no Location.
+// The certificate's private key is certKey.
+//
+// The returned certificate has its Leaf parsed, and can be used with origin.NewServerWithCerts.
+// To renew it, call ObtainCertificate again before cert.Leaf.NotAfter,
+// or use ManageCertificate instead.
+//
+// Usage:
+//
+//	solver, err := acmecf.NewDNS01Solver("[Zone ID]", "[Edit zone DNS Token]")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	cert, err := acmecf.ObtainCertificate(ctx, acmecf.LetsEncrypt, account, certKey, solver, "example.com")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	server := origin.NewServerWithCerts(nil, cert)
+func ObtainCertificate(ctx context.Context, directory string, account acme.Account, certKey crypto.Signer, solver *DNS01Solver, domains ...string) (tls.Certificate, error) {
+	client := newClient(directory, solver)
+
+	account, err := register(ctx, client, account)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return obtain(ctx, client, account, certKey, domains)
+}
+
+func newClient(directory string, solver *DNS01Solver) *acmez.Client {
+	return &acmez.Client{
+		Client: &acme.Client{Directory: directory},
+		ChallengeSolvers: map[string]acmez.Solver{
+			acme.ChallengeTypeDNS01: solver,
+		},
+	}
+}
+
+func register(ctx context.Context, client *acmez.Client, account acme.Account) (acme.Account, error) {
+	if account.Location != "" {
+		return account, nil
+	}
+	return client.NewAccount(ctx, account)
+}
+
+func obtain(ctx context.Context, client *acmez.Client, account acme.Account, certKey crypto.Signer, domains []string) (tls.Certificate, error) {
+	certs, err := client.ObtainCertificate(ctx, account, certKey, domains)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if len(certs) == 0 {
+		return tls.Certificate{}, errors.New("no certificate obtained")
+	}
+
+	cert := tls.Certificate{PrivateKey: certKey}
+	for rest := certs[0].ChainPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("no certificate found in chain")
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return cert, nil
+}
+
+// ManagedCertificate is a certificate obtained with ManageCertificate,
+// which is renewed in the background before it expires.
+type ManagedCertificate struct {
+	cert atomic.Pointer[tls.Certificate]
+	err  atomic.Pointer[error]
+}
+
+// ManageCertificate obtains a certificate like ObtainCertificate,
+// then renews it in the background until ctx is done.
+//
+// Renewal starts after two thirds of the certificate's lifetime.
+// Failed renewals are retried hourly (or more often, for short-lived certificates),
+// while the current certificate is still served.
+//
+// Usage:
+//
+//	cert, err := acmecf.ManageCertificate(ctx, acmecf.LetsEncrypt, account, certKey, solver, "example.com")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	server := origin.NewServerWithOptions(nil, nil, origin.GetCertificate(cert.GetCertificate))
+func ManageCertificate(ctx context.Context, directory string, account acme.Account, certKey crypto.Signer, solver *DNS01Solver, domains ...string) (*ManagedCertificate, error) {
+	client := newClient(directory, solver)
+
+	account, err := register(ctx, client, account)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := obtain(ctx, client, account, certKey, domains)
+	if err != nil {
+		return nil, err
+	}
+
+	var m ManagedCertificate
+	m.cert.Store(&cert)
+	go m.renew(ctx, func(ctx context.Context) (tls.Certificate, error) {
+		return obtain(ctx, client, account, certKey, domains)
+	})
+	return &m, nil
+}
+
+func (m *ManagedCertificate) renew(ctx context.Context, obtain func(context.Context) (tls.Certificate, error)) {
+	for {
+		leaf := m.cert.Load().Leaf
+		lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+		wait := time.Until(leaf.NotBefore.Add(lifetime * 2 / 3))
+		if err := m.Err(); err != nil {
+			wait = min(lifetime/10, time.Hour)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		cert, err := obtain(ctx)
+		if err != nil {
+			m.err.Store(&err)
+			continue
+		}
+		m.cert.Store(&cert)
+		m.err.Store(nil)
+	}
+}
+
+// Certificate returns the current certificate.
+func (m *ManagedCertificate) Certificate() tls.Certificate {
+	return *m.cert.Load()
+}
+
+// GetCertificate returns the current certificate,
+// and can be used as tls.Config.GetCertificate.
+func (m *ManagedCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.cert.Load(), nil
+}
+
+// Err returns the error of the last renewal, if it failed.
+func (m *ManagedCertificate) Err() error {
+	if err := m.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package acmecf
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// acmeServer is a minimal ACME CA, which issues certificates valid for lifetime,
+// once a DNS-01 challenge is presented in records.
+type acmeServer struct {
+	*httptest.Server
+	lifetime time.Duration
+
+	mutex   sync.Mutex
+	records map[string]string
+	orders  int
+	valid   bool
+	cert    []byte
+}
+
+func newACMEServer(t *testing.T, lifetime time.Duration) *acmeServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	s := &acmeServer{
+		lifetime: lifetime,
+		records:  map[string]string{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		url := s.URL
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		var jws struct{ Payload string }
+		json.NewDecoder(r.Body).Decode(&jws)
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+		var res any
+		switch path := r.URL.Path; {
+		case path == "/directory":
+			res = map[string]string{
+				"newNonce":   url + "/nonce",
+				"newAccount": url + "/account",
+				"newOrder":   url + "/order",
+			}
+		case path == "/account":
+			w.Header().Set("Location", url+"/account/1")
+			w.WriteHeader(http.StatusCreated)
+			res = map[string]string{"status": acme.StatusValid}
+		case path == "/order":
+			s.orders++
+			s.valid = false
+			w.Header().Set("Location", url+"/order/1")
+			w.WriteHeader(http.StatusCreated)
+			res = s.order(acme.StatusPending, "")
+		case path == "/authz":
+			status := acme.StatusPending
+			if s.valid {
+				status = acme.StatusValid
+			}
+			res = acme.Authorization{
+				Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+				Status:     status,
+				Challenges: []acme.Challenge{{
+					Type:   acme.ChallengeTypeDNS01,
+					URL:    url + "/challenge",
+					Token:  "token",
+					Status: status,
+				}},
+			}
+		case path == "/challenge":
+			s.valid = s.records["_acme-challenge.example.com"] != ""
+			res = map[string]string{"type": acme.ChallengeTypeDNS01, "url": url + "/challenge", "token": "token", "status": acme.StatusProcessing}
+		case path == "/finalize":
+			var req struct{ CSR string }
+			json.Unmarshal(payload, &req)
+			der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil || !s.valid {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(acme.Problem{Type: "urn:ietf:params:acme:error:unauthorized"})
+				return
+			}
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(int64(s.orders)),
+				DNSNames:     csr.DNSNames,
+				NotBefore:    time.Now(),
+				NotAfter:     time.Now().Add(s.lifetime),
+			}
+			der, err = x509.CreateCertificate(rand.Reader, tmpl, ca, csr.PublicKey, key)
+			if err != nil {
+				t.Error(err)
+			}
+			s.cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+			res = s.order(acme.StatusValid, url+"/cert")
+		case path == "/order/1":
+			res = s.order(acme.StatusValid, url+"/cert")
+		case path == "/cert":
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			w.Write(s.cert)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *acmeServer) order(status, cert string) acme.Order {
+	return acme.Order{
+		Status:         status,
+		Identifiers:    []acme.Identifier{{Type: "dns", Value: "example.com"}},
+		Authorizations: []string{s.URL + "/authz"},
+		Finalize:       s.URL + "/finalize",
+		Certificate:    cert,
+	}
+}
+
+func (s *acmeServer) solver() *DNS01Solver {
+	return &DNS01Solver{
+		CreateRecord: func(ctx context.Context, name, value string) (string, error) {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.records[name] = value
+			return name, nil
+		},
+		DeleteRecord: func(ctx context.Context, id string) error {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			delete(s.records, id)
+			return nil
+		},
+		PropagationChecker: func(ctx context.Context, name, value string) (bool, error) {
+			return true, nil
+		},
+	}
+}
+
+func testAccount(t *testing.T) acme.Account {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acme.Account{PrivateKey: key, TermsOfServiceAgreed: true}
+}
+
+func TestObtainCertificate(t *testing.T) {
+	srv := newACMEServer(t, time.Hour)
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	cert, err := ObtainCertificate(context.Background(), srv.URL+"/directory", testAccount(t), certKey, srv.solver(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("example.com"); err != nil {
+		t.Error(err)
+	}
+	if cert.PrivateKey != certKey {
+		t.Error("wrong private key")
+	}
+	if len(srv.records) != 0 {
+		t.Errorf("records not cleaned up: %v", srv.records)
+	}
+}
+
+func TestManageCertificate(t *testing.T) {
+	srv := newACMEServer(t, 600*time.Millisecond)
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cert, err := ManageCertificate(ctx, srv.URL+"/directory", testAccount(t), certKey, srv.solver(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := cert.GetCertificate(nil)
+
+	// renewed after two thirds of its lifetime
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if got, _ := cert.GetCertificate(nil); got.Leaf.SerialNumber.Cmp(first.Leaf.SerialNumber) != 0 {
+			if got.Leaf.NotAfter.Before(first.Leaf.NotAfter) {
+				t.Error("renewed to an older certificate")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not renewed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := cert.Err(); err != nil {
+		t.Error(err)
+	}
+}
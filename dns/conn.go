@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsConn is a net.Conn that hands each DNS message
+// written to it to a roundTripper, and buffers the answer.
+type dnsConn struct {
+	sync.Mutex
+
+	ibuf bytes.Buffer
+	obuf bytes.Buffer
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	deadline  time.Time
+	roundTrip roundTripper
+}
+
+type roundTripper func(ctx context.Context, req string) (res string, err error)
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (c *dnsConn) Read(b []byte) (n int, err error) {
+	imsg, n, err := c.drainBuffers(b)
+	if n != 0 || err != nil {
+		return n, err
+	}
+
+	ctx, cancel := c.childContext()
+	omsg, err := c.roundTrip(ctx, imsg)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+
+	return c.fillBuffer(b, omsg)
+}
+
+func (c *dnsConn) Write(b []byte) (n int, err error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.ibuf.Write(b)
+}
+
+func (c *dnsConn) Close() error {
+	c.Lock()
+	cancel := c.cancel
+	c.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
+
+func (c *dnsConn) LocalAddr() net.Addr  { return nil }
+func (c *dnsConn) RemoteAddr() net.Addr { return nil }
+
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+func (c *dnsConn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dnsConn) SetWriteDeadline(t time.Time) error {
+	// writes do not timeout
+	return nil
+}
+
+func (c *dnsConn) drainBuffers(b []byte) (string, int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	// drain the output buffer
+	if c.obuf.Len() > 0 {
+		n, err := c.obuf.Read(b)
+		return "", n, err
+	}
+
+	// otherwise, get the next message from the input buffer
+	sz := c.ibuf.Next(2)
+	if len(sz) < 2 {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+
+	size := int64(sz[0])<<8 | int64(sz[1])
+
+	var str strings.Builder
+	_, err := io.CopyN(&str, &c.ibuf, size)
+	if err == io.EOF {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return str.String(), 0, nil
+}
+
+func (c *dnsConn) fillBuffer(b []byte, str string) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.obuf.WriteByte(byte(len(str) >> 8))
+	c.obuf.WriteByte(byte(len(str)))
+	c.obuf.WriteString(str)
+	return c.obuf.Read(b)
+}
+
+func (c *dnsConn) childContext() (context.Context, context.CancelFunc) {
+	c.Lock()
+	defer c.Unlock()
+	if c.ctx == nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(c.ctx, c.deadline)
+}
+
+// exchange sends a DNS message over a connection obtained from dial,
+// and returns the answer.
+// A nil dial connects directly to address.
+func exchange(ctx context.Context, dial dialFunc, network, address, req string) (string, error) {
+	var conn net.Conn
+	var err error
+	if dial != nil {
+		conn, err = dial(ctx, network, address)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	defer cancel()
+
+	if t, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(t)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = writeMessage(conn, req)
+	if err != nil {
+		return "", err
+	}
+	return readMessage(conn)
+}
+
+func writeMessage(conn net.Conn, msg string) error {
+	var buf []byte
+	if _, ok := conn.(net.PacketConn); ok {
+		buf = []byte(msg)
+	} else {
+		buf = make([]byte, len(msg)+2)
+		buf[0] = byte(len(msg) >> 8)
+		buf[1] = byte(len(msg))
+		copy(buf[2:], msg)
+	}
+	// single write for both TCP and UDP
+	_, err := conn.Write(buf)
+	return err
+}
+
+func readMessage(conn net.Conn) (string, error) {
+	if _, ok := conn.(net.PacketConn); ok {
+		b := make([]byte, 4096)
+		n, err := conn.Read(b)
+		if err != nil {
+			return "", err
+		}
+		return string(b[:n]), nil
+	}
+
+	var sz [2]byte
+	_, err := io.ReadFull(conn, sz[:])
+	if err != nil {
+		return "", err
+	}
+
+	size := int64(sz[0])<<8 | int64(sz[1])
+
+	var str strings.Builder
+	_, err = io.CopyN(&str, conn, size)
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return str.String(), nil
+}
+
+// serverFailure checks if a DNS answer has the SERVFAIL response code.
+func serverFailure(res string) bool {
+	return len(res) > 3 && res[3]&0xf == 2
+}
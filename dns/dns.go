@@ -4,20 +4,135 @@
 // https://github.com/ncruces/go-dns
 //
 // Usage:
+//
 //	import _ "github.com/ncruces/go-cloudflare/dns"
 package dns
 
 import (
+	"context"
 	"net"
+	"net/http"
+	"time"
 
 	"github.com/ncruces/go-dns"
 )
 
+// Cloudflare's DNS over HTTPS endpoints.
+const (
+	DefaultEndpoint  = "https://cloudflare-dns.com/dns-query"
+	SecurityEndpoint = "https://security.cloudflare-dns.com/dns-query" // blocks malware
+	FamilyEndpoint   = "https://family.cloudflare-dns.com/dns-query"   // blocks malware and adult content
+)
+
+var bootstrap = map[string][]string{
+	DefaultEndpoint: {
+		"2606:4700:4700::1111", "1.1.1.1",
+		"2606:4700:4700::1001", "1.0.0.1"},
+	SecurityEndpoint: {
+		"2606:4700:4700::1112", "1.1.1.2",
+		"2606:4700:4700::1002", "1.0.0.2"},
+	FamilyEndpoint: {
+		"2606:4700:4700::1113", "1.1.1.3",
+		"2606:4700:4700::1003", "1.0.0.3"},
+}
+
+// resolver is the package's resolver, installed as the net.DefaultResolver.
+var resolver *net.Resolver
+
 func init() {
-	net.DefaultResolver, _ = dns.NewDoHResolver(
-		"https://cloudflare-dns.com/dns-query",
-		dns.DoHAddresses(
-			"2606:4700:4700::1111", "1.1.1.1",
-			"2606:4700:4700::1001", "1.0.0.1"),
-		dns.DoHCache())
+	resolver, _ = NewResolver(DefaultEndpoint)
+	net.DefaultResolver = resolver
+}
+
+// DialContext connects to address, resolving its host with Cloudflare's 1.1.1.1,
+// even if net.DefaultResolver is later replaced.
+//
+// This scopes DNS over HTTPS to particular clients:
+//
+//	transport := &http.Transport{DialContext: dns.DialContext}
+//
+// Importing the package still replaces the net.DefaultResolver;
+// to restore the system's resolver for the rest of the process:
+//
+//	net.DefaultResolver = &net.Resolver{}
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d := net.Dialer{Resolver: resolver}
+	return d.DialContext(ctx, network, address)
 }
+
+// NewResolver creates a caching DNS over HTTPS resolver for endpoint.
+//
+// The endpoint may be one of Cloudflare's, or any other DNS over HTTPS URL (e.g. an internal resolver).
+// Bootstrap addresses for Cloudflare's endpoints are known;
+// for other endpoints, use the Addresses option to avoid resolving the endpoint's hostname.
+func NewResolver(endpoint string, options ...Option) (*net.Resolver, error) {
+	var opts resolverOpts
+	for _, o := range options {
+		o.apply(&opts)
+	}
+	if opts.addrs == nil {
+		opts.addrs = bootstrap[endpoint]
+	}
+
+	var doh []dns.DoHOption
+	if len(opts.addrs) > 0 {
+		// copy, as DoHAddresses takes ownership of the slice
+		addrs := append([]string(nil), opts.addrs...)
+		doh = append(doh, dns.DoHAddresses(addrs...))
+	}
+	resolver, err := dns.NewDoHResolver(endpoint, doh...)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.http3 != nil {
+		resolver.Dial = http3Dialer(endpoint, opts.http3, resolver.Dial)
+	}
+
+	if opts.timeout > 0 || opts.attempts > 1 {
+		resolver.Dial = retryDialer(resolver.Dial, opts.timeout, opts.attempts)
+	}
+
+	resolver.Dial = countingDialer(resolver.Dial, !opts.noCache)
+	return resolver, nil
+}
+
+// countingDialer caches queries through dial, if cache is set,
+// and counts queries before and after the cache.
+func countingDialer(dial dns.DialFunc, cache bool) dns.DialFunc {
+	if !cache {
+		// every query goes upstream
+		return countQueries(countUpstream(dial))
+	}
+	return countQueries(dns.NewCachingDialer(countUpstream(dial)))
+}
+
+// An Option customizes the resolver created by NewResolver.
+type Option interface {
+	apply(*resolverOpts)
+}
+
+type resolverOpts struct {
+	addrs    []string
+	http3    http.RoundTripper
+	timeout  time.Duration
+	attempts int
+	noCache  bool
+}
+
+type addressesOption []string
+
+func (o addressesOption) apply(r *resolverOpts) { r.addrs = ([]string)(o) }
+
+// Addresses sets the bootstrap network addresses of the resolver.
+// These should be IP addresses, or network addresses of the form "IP:port".
+func Addresses(addresses ...string) Option { return addressesOption(addresses) }
+
+type noCacheOption struct{}
+
+func (noCacheOption) apply(r *resolverOpts) { r.noCache = true }
+
+// NoCache disables the resolver's in-process cache, so every query goes to the endpoint,
+// e.g. to honor very short TTLs, or to audit every lookup.
+// The resolver installed as the net.DefaultResolver is always cached.
+func NoCache() Option { return noCacheOption{} }
@@ -1,8 +1,15 @@
 package dns
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDNS(t *testing.T) {
@@ -12,3 +19,316 @@ func TestDNS(t *testing.T) {
 		t.Log(ips)
 	}
 }
+
+func TestNewResolver(t *testing.T) {
+	srv, _ := dohServer(t, "192.0.2.1")
+
+	// the endpoint's host is never resolved: bootstrap addresses are dialed
+	resolver, err := NewResolver("http://doh.example/dns-query", Addresses(srv.Listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips, err := resolver.LookupIP(context.Background(), "ip4", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("got %v", ips)
+	}
+}
+
+func TestNewResolver_NoCache(t *testing.T) {
+	for cache, want := range map[bool]int{true: 1, false: 2} {
+		srv, queries := dohServer(t, "192.0.2.1")
+
+		options := []Option{Addresses(srv.Listener.Addr().String())}
+		if !cache {
+			options = append(options, NoCache())
+		}
+		resolver, err := NewResolver("http://doh.example/dns-query", options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := resolver.LookupIP(context.Background(), "ip4", "example.com"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if *queries != want {
+			t.Errorf("cache %v: got %d queries upstream, want %d", cache, *queries, want)
+		}
+	}
+}
+
+// dohServer is a DNS over HTTPS endpoint at doh.example, that answers every A query with ip,
+// and counts queries.
+func dohServer(t *testing.T, ip string) (*httptest.Server, *int) {
+	var queries int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		if r.Host != "doh.example" || r.URL.Path != "/dns-query" {
+			t.Errorf("got request for %s%s", r.Host, r.URL.Path)
+		}
+		msg, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		io.WriteString(w, fakeAnswer(string(msg), net.ParseIP(ip).To4()))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &queries
+}
+
+func TestNewResolverWithFallback(t *testing.T) {
+	primary := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+	}
+
+	resolver := NewResolverWithFallback(primary, fakeResolver("192.0.2.1"))
+
+	ips, err := resolver.LookupIP(context.Background(), "ip4", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("got %v", ips)
+	}
+}
+
+func TestReadStats(t *testing.T) {
+	for cache, hits := range map[bool]int64{true: 1, false: 0} {
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial:     countingDialer(fakeResolver("192.0.2.1").Dial, cache),
+		}
+
+		before := ReadStats()
+		for i := 0; i < 2; i++ {
+			_, err := resolver.LookupIP(context.Background(), "ip4", "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		after := ReadStats()
+
+		if n := after.Queries - before.Queries; n != 2 {
+			t.Errorf("cache %v: got %d queries", cache, n)
+		}
+		if n := after.CacheHits - before.CacheHits; n != hits {
+			t.Errorf("cache %v: got %d cache hits, want %d", cache, n, hits)
+		}
+		if after.InFlight != 0 {
+			t.Errorf("cache %v: got %d in flight", cache, after.InFlight)
+		}
+	}
+}
+
+func Test_http3Dialer(t *testing.T) {
+	var calls int
+	h3 := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls > 1 {
+			return nil, errors.New("no HTTP/3")
+		}
+		msg, _ := io.ReadAll(req.Body)
+		answer := fakeAnswer(string(msg), net.IPv4(192, 0, 2, 3).To4())
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(answer))}, nil
+	})
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial:     http3Dialer(DefaultEndpoint, h3, fakeResolver("192.0.2.2").Dial),
+	}
+
+	// HTTP/3, then fallback, then no retry
+	for _, want := range []string{"192.0.2.3", "192.0.2.2", "192.0.2.2"} {
+		ips, err := resolver.LookupIP(context.Background(), "ip4", "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || ips[0].String() != want {
+			t.Errorf("got %v, want %s", ips, want)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("got %d HTTP/3 calls", calls)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// fakeResolver answers every A query with ip.
+func fakeResolver(ip string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := &dnsConn{}
+			conn.roundTrip = func(ctx context.Context, req string) (string, error) {
+				return fakeAnswer(req, net.ParseIP(ip).To4()), nil
+			}
+			return conn, nil
+		},
+	}
+}
+
+func fakeAnswer(req string, ip net.IP) string {
+	// find the end of the question
+	end := 12
+	for end < len(req) && req[end] != 0 {
+		end += int(req[end]) + 1
+	}
+	end += 5
+
+	var res strings.Builder
+	res.WriteString(req[:2])                            // ID
+	res.WriteString("\x81\x80")                         // response, recursion available
+	res.WriteString("\x00\x01\x00\x01\x00\x00\x00\x00") // counts
+	res.WriteString(req[12:end])                        // question
+	res.WriteString("\xc0\x0c")                         // name pointer
+	res.WriteString("\x00\x01\x00\x01")                 // type A, class IN
+	res.WriteString("\x00\x00\x00\x3c\x00\x04")         // TTL, length
+	res.Write(ip)
+	return res.String()
+}
+
+func TestNewShardedResolver(t *testing.T) {
+	resolver := NewShardedResolver(fakeResolver("192.0.2.1"), fakeResolver("192.0.2.2"))
+
+	seen := map[string]string{}
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com"} {
+		for _, n := range []string{name, strings.ToUpper(name)} {
+			ips, err := resolver.LookupIP(context.Background(), "ip4", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prev, ok := seen[name]; ok && prev != ips[0].String() {
+				t.Errorf("%s: got %v and %v", n, prev, ips[0])
+			}
+			seen[name] = ips[0].String()
+		}
+	}
+
+	// a failing resolver is skipped
+	unreachable := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+	}
+	resolver = NewShardedResolver(unreachable, fakeResolver("192.0.2.1"))
+	for name := range seen {
+		ips, err := resolver.LookupIP(context.Background(), "ip4", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+			t.Errorf("%s: got %v", name, ips)
+		}
+	}
+}
+
+func Test_shard(t *testing.T) {
+	counts := make([]int, 3)
+	for _, c := range "abcdefghijklmnopqrstuvwxyz" {
+		q := "\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00" + "\x01" + string(c) + "\x07example\x03com\x00\x00\x01\x00\x01"
+		counts[shard(q, 3)]++
+	}
+	for i, n := range counts {
+		if n == 0 {
+			t.Errorf("resolver %d got no queries", i)
+		}
+	}
+	if got := shard("\x00\x01", 3); got != 0 {
+		t.Errorf("truncated query: got %d", got)
+	}
+}
+
+func TestNewSplitResolver(t *testing.T) {
+	resolver := NewSplitResolver(fakeResolver("192.0.2.1"), fakeResolver("192.0.2.2"), "corp.example.com.")
+
+	tests := map[string]string{
+		"example.com":          "192.0.2.1",
+		"notcorp.example.com":  "192.0.2.1",
+		"corp.example.com":     "192.0.2.2",
+		"www.CORP.example.com": "192.0.2.2",
+	}
+	for name, want := range tests {
+		ips, err := resolver.LookupIP(context.Background(), "ip4", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || ips[0].String() != want {
+			t.Errorf("%s: got %v, want %s", name, ips, want)
+		}
+	}
+}
+
+func TestProbeResolver(t *testing.T) {
+	if err := ProbeResolver(context.Background(), fakeResolver("192.0.2.1")); err != nil {
+		t.Error(err)
+	}
+
+	unreachable := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+	}
+	if err := ProbeResolver(context.Background(), unreachable); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// IP addresses need no resolution
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c, err := DialContext(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func Test_retryDialer(t *testing.T) {
+	var calls int
+	flaky := func(ctx context.Context, network, address string) (net.Conn, error) {
+		calls++
+		if calls < 3 {
+			return nil, errors.New("unreachable")
+		}
+		return fakeResolver("192.0.2.1").Dial(ctx, network, address)
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial:     retryDialer(flaky, 0, 3),
+	}
+	ips, err := resolver.LookupIP(context.Background(), "ip4", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) || calls != 3 {
+		t.Errorf("got %v after %d calls", ips, calls)
+	}
+
+	// slow attempts time out
+	slow := func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	start := time.Now()
+	_, err = exchange(context.Background(), dialFunc(retryDialer(slow, 10*time.Millisecond, 2)), "udp", "", "query")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("took %v", d)
+	}
+}
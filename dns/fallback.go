@@ -0,0 +1,51 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// NewResolverWithFallback creates a net.Resolver that tries primary first,
+// and falls back to fallback if primary fails or times out.
+//
+// When the query has a deadline, primary gets at most half the available time,
+// leaving the rest for fallback.
+// A nil fallback (or one without a Dial function) queries the system's DNS servers.
+//
+// Usage:
+//
+//	net.DefaultResolver = dns.NewResolverWithFallback(net.DefaultResolver, nil)
+func NewResolverWithFallback(primary, fallback *net.Resolver) *net.Resolver {
+	var primaryDial, fallbackDial dialFunc
+	if primary != nil {
+		primaryDial = primary.Dial
+	}
+	if fallback != nil {
+		fallbackDial = fallback.Dial
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := &dnsConn{}
+			conn.roundTrip = func(ctx context.Context, req string) (string, error) {
+				pctx, cancel := primaryContext(ctx)
+				res, err := exchange(pctx, primaryDial, network, address, req)
+				cancel()
+				if err == nil && !serverFailure(res) {
+					return res, nil
+				}
+				return exchange(ctx, fallbackDial, network, address, req)
+			}
+			return conn, nil
+		},
+	}
+}
+
+func primaryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(ctx, deadline.Add(-time.Until(deadline)/2))
+	}
+	return context.WithCancel(ctx)
+}
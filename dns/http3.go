@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ncruces/go-dns"
+)
+
+type http3Option struct{ rt http.RoundTripper }
+
+func (o http3Option) apply(r *resolverOpts) { r.http3 = o.rt }
+
+// HTTP3 sends queries with rt, an HTTP/3 round tripper
+// (e.g. an http3.Transport from github.com/quic-go/quic-go/http3),
+// falling back to HTTP/2 when HTTP/3 is unavailable.
+//
+// HTTP/3 can cut latency on lossy or high-latency networks.
+// After a failure, HTTP/3 is not retried for a minute.
+//
+// The round tripper must not use the resolver to resolve the endpoint's hostname.
+// For Cloudflare's endpoints, dial the bootstrap addresses instead (e.g. 1.1.1.1:443).
+func HTTP3(rt http.RoundTripper) Option { return http3Option{rt} }
+
+// http3Dialer sends queries to uri using rt,
+// falling back to dialing fallback.
+func http3Dialer(uri string, rt http.RoundTripper, fallback dns.DialFunc) dns.DialFunc {
+	uri, _, _ = strings.Cut(uri, "{") // drop any URI template
+	client := &http.Client{Transport: rt}
+	var retry atomic.Int64
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn := &dnsConn{}
+		conn.roundTrip = func(ctx context.Context, req string) (string, error) {
+			if time.Now().UnixNano() >= retry.Load() {
+				res, err := dohExchange(ctx, client, uri, req)
+				if err == nil {
+					return res, nil
+				}
+				if ctx.Err() != nil {
+					return "", err
+				}
+				retry.Store(time.Now().Add(time.Minute).UnixNano())
+			}
+			return exchange(ctx, dialFunc(fallback), network, address, req)
+		}
+		return conn, nil
+	}
+}
+
+func dohExchange(ctx context.Context, client *http.Client, uri, msg string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, strings.NewReader(msg))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New(http.StatusText(res.StatusCode))
+	}
+
+	var str strings.Builder
+	_, err = io.Copy(&str, io.LimitReader(res.Body, 65535))
+	if err != nil {
+		return "", err
+	}
+	return str.String(), nil
+}
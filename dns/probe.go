@@ -0,0 +1,40 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+)
+
+// Probe checks that net.DefaultResolver is usable,
+// returning an error if a lookup fails or times out.
+//
+// Usage, in a readiness check:
+//
+//	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+//	defer cancel()
+//	err := dns.Probe(ctx)
+func Probe(ctx context.Context) error {
+	return ProbeResolver(ctx, net.DefaultResolver)
+}
+
+// ProbeResolver checks that r is usable,
+// returning an error if a lookup fails or times out.
+//
+// The lookup is for a unique name under one.one.one.one,
+// so the answer can't come from a cache;
+// an answer that the name doesn't exist is a success.
+func ProbeResolver(ctx context.Context, r *net.Resolver) error {
+	var buf [8]byte
+	rand.Read(buf[:])
+	name := hex.EncodeToString(buf[:]) + ".one.one.one.one."
+
+	_, err := r.LookupHost(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/ncruces/go-dns"
+)
+
+type (
+	timeoutOption  time.Duration
+	attemptsOption int
+)
+
+func (o timeoutOption) apply(r *resolverOpts)  { r.timeout = time.Duration(o) }
+func (o attemptsOption) apply(r *resolverOpts) { r.attempts = int(o) }
+
+// Timeout limits each attempt to query the endpoint to d,
+// so a slow endpoint fails fast, into a retry (see Attempts),
+// or a fallback (see NewResolverWithFallback).
+//
+// Queries are also limited by the system's resolver timeout (5 seconds by default, see resolv.conf).
+func Timeout(d time.Duration) Option { return timeoutOption(d) }
+
+// Attempts sets how many times a failed query is sent to the endpoint (once, by default).
+// Only failures to get an answer are retried, not negative answers.
+func Attempts(n int) Option { return attemptsOption(n) }
+
+// retryDialer sends queries through dial, up to attempts times,
+// each limited by timeout, if positive.
+func retryDialer(dial dns.DialFunc, timeout time.Duration, attempts int) dns.DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn := &dnsConn{}
+		conn.roundTrip = func(ctx context.Context, req string) (res string, err error) {
+			for i := 0; i < max(attempts, 1); i++ {
+				res, err = exchangeTimeout(ctx, dialFunc(dial), network, address, req, timeout)
+				if err == nil || ctx.Err() != nil {
+					break
+				}
+			}
+			return res, err
+		}
+		return conn, nil
+	}
+}
+
+func exchangeTimeout(ctx context.Context, dial dialFunc, network, address, req string, timeout time.Duration) (string, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return exchange(ctx, dial, network, address, req)
+}
@@ -0,0 +1,87 @@
+package dns
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+)
+
+// Other providers' DNS over HTTPS endpoints, e.g. for NewShardedResolver.
+const (
+	GoogleEndpoint = "https://dns.google/dns-query"
+	Quad9Endpoint  = "https://dns.quad9.net/dns-query"
+)
+
+func init() {
+	bootstrap[GoogleEndpoint] = []string{
+		"2001:4860:4860::8888", "8.8.8.8",
+		"2001:4860:4860::8844", "8.8.4.4"}
+	bootstrap[Quad9Endpoint] = []string{
+		"2620:fe::fe", "9.9.9.9",
+		"2620:fe::9", "149.112.112.112"}
+}
+
+// NewShardedResolver creates a net.Resolver that spreads queries across resolvers,
+// so that no single provider sees all the names you look up.
+//
+// Each name is always sent to the same resolver, chosen by hashing the name;
+// if it fails, the others are tried in turn.
+// As with NewResolverWithFallback, when the query has a deadline,
+// the first try gets at most half the available time.
+// Queries that can't be parsed go to the first resolver.
+// A nil resolver (or one without a Dial function) queries the system's DNS servers.
+//
+// Usage:
+//
+//	cloudflare, _ := dns.NewResolver(dns.DefaultEndpoint)
+//	quad9, _ := dns.NewResolver(dns.Quad9Endpoint)
+//	net.DefaultResolver = dns.NewShardedResolver(cloudflare, quad9)
+func NewShardedResolver(resolvers ...*net.Resolver) *net.Resolver {
+	// with no resolvers, query the system's DNS servers
+	dials := make([]dialFunc, max(1, len(resolvers)))
+	for i, r := range resolvers {
+		if r != nil {
+			dials[i] = r.Dial
+		}
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := &dnsConn{}
+			conn.roundTrip = func(ctx context.Context, req string) (res string, err error) {
+				first := shard(req, len(dials))
+				for i := range dials {
+					dial := dials[(first+i)%len(dials)]
+					if i == 0 && len(dials) > 1 {
+						pctx, cancel := primaryContext(ctx)
+						res, err = exchange(pctx, dial, network, address, req)
+						cancel()
+					} else {
+						res, err = exchange(ctx, dial, network, address, req)
+					}
+					if err == nil && !serverFailure(res) {
+						break
+					}
+				}
+				return res, err
+			}
+			return conn, nil
+		},
+	}
+}
+
+// shard picks one of n resolvers for the name in query.
+func shard(query string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+
+	name, ok := questionName(query)
+	if !ok {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// NewSplitResolver creates a net.Resolver that sends queries for names
+// under any of suffixes (e.g. "corp.example.com", "internal", "in-addr.arpa")
+// to private, and all other queries to public.
+//
+// This allows using DNS over HTTPS for public names,
+// without breaking the resolution of internal names.
+// A nil resolver (or one without a Dial function) queries the system's DNS servers.
+//
+// Usage:
+//
+//	public, _ := dns.NewResolver(dns.DefaultEndpoint)
+//	net.DefaultResolver = dns.NewSplitResolver(public, nil, "corp.example.com")
+func NewSplitResolver(public, private *net.Resolver, suffixes ...string) *net.Resolver {
+	var publicDial, privateDial dialFunc
+	if public != nil {
+		publicDial = public.Dial
+	}
+	if private != nil {
+		privateDial = private.Dial
+	}
+
+	rules := make([]string, len(suffixes))
+	for i, s := range suffixes {
+		rules[i] = strings.ToLower(strings.Trim(s, "."))
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := &dnsConn{}
+			conn.roundTrip = func(ctx context.Context, req string) (string, error) {
+				dial := publicDial
+				if name, ok := questionName(req); ok && matchSuffix(name, rules) {
+					dial = privateDial
+				}
+				return exchange(ctx, dial, network, address, req)
+			}
+			return conn, nil
+		},
+	}
+}
+
+// matchSuffix reports whether name is equal to, or a subdomain of, any of suffixes.
+func matchSuffix(name string, suffixes []string) bool {
+	for _, s := range suffixes {
+		switch {
+		case s == "":
+			return true
+		case name == s:
+			return true
+		case strings.HasSuffix(name, s) && name[len(name)-len(s)-1] == '.':
+			return true
+		}
+	}
+	return false
+}
+
+// questionName returns the lowercase name in the question of query,
+// without the trailing dot.
+func questionName(query string) (string, bool) {
+	var name strings.Builder
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		end := i + int(query[i]) + 1
+		if end > len(query) || query[i] >= 0x40 { // compression pointers aren't expected
+			return "", false
+		}
+		if name.Len() > 0 {
+			name.WriteByte('.')
+		}
+		name.WriteString(strings.ToLower(query[i+1 : end]))
+		i = end
+	}
+	if i >= len(query) {
+		return "", false
+	}
+	return name.String(), true
+}
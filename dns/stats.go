@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ncruces/go-dns"
+)
+
+// Stats are counters for the resolvers created by NewResolver
+// (including the net.DefaultResolver).
+type Stats struct {
+	Queries     int64         // queries answered, from the cache or upstream
+	CacheHits   int64         // queries answered from the cache
+	CacheMisses int64         // queries sent upstream
+	InFlight    int64         // upstream queries awaiting an answer
+	Failures    int64         // upstream queries that failed
+	LastLatency time.Duration // latency of the last successful upstream query
+	LastError   error         // error of the last failed upstream query
+}
+
+var stats struct {
+	queries     atomic.Int64
+	misses      atomic.Int64
+	inFlight    atomic.Int64
+	failures    atomic.Int64
+	lastLatency atomic.Int64
+	lastError   atomic.Pointer[error]
+}
+
+// ReadStats returns a snapshot of the package's counters.
+func ReadStats() Stats {
+	s := Stats{
+		CacheMisses: stats.misses.Load(),
+		InFlight:    stats.inFlight.Load(),
+		Failures:    stats.failures.Load(),
+		LastLatency: time.Duration(stats.lastLatency.Load()),
+	}
+	// load misses before queries, so hits are never negative
+	s.Queries = stats.queries.Load()
+	s.CacheHits = s.Queries - s.CacheMisses
+	if err := stats.lastError.Load(); err != nil {
+		s.LastError = *err
+	}
+	return s
+}
+
+// countQueries counts queries made through dial,
+// which may be answered from the cache.
+func countQueries(dial dns.DialFunc) dns.DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn := &dnsConn{}
+		conn.roundTrip = func(ctx context.Context, req string) (string, error) {
+			stats.queries.Add(1)
+			return exchange(ctx, dialFunc(dial), network, address, req)
+		}
+		return conn, nil
+	}
+}
+
+// countUpstream counts and times queries made through dial,
+// which go upstream.
+func countUpstream(dial dns.DialFunc) dns.DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn := &dnsConn{}
+		conn.roundTrip = func(ctx context.Context, req string) (string, error) {
+			stats.misses.Add(1)
+			stats.inFlight.Add(1)
+			defer stats.inFlight.Add(-1)
+
+			start := time.Now()
+			res, err := exchange(ctx, dialFunc(dial), network, address, req)
+			if err != nil {
+				stats.failures.Add(1)
+				stats.lastError.Store(&err)
+			} else {
+				stats.lastLatency.Store(int64(time.Since(start)))
+			}
+			return res, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,27 @@
+package dyndns
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// sharedAddressSpace is used by carrier-grade NAT (RFC 6598).
+var sharedAddressSpace = net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// checkCGNAT checks that the public IPv4 likely routes back to this host.
+func (up *Updater) checkCGNAT(ctx context.Context, public string) error {
+	ip := net.ParseIP(public)
+	if sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: public IP %s", ErrCGNAT, public)
+	}
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("%w: public IP %s isn't public", ErrCGNAT, public)
+	}
+
+	// the local address is best effort
+	if local, err := up.localIP(ctx, "ip4"); err == nil && sharedAddressSpace.Contains(net.ParseIP(local)) {
+		return fmt.Errorf("%w: local address %s", ErrCGNAT, local)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package dyndns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// syncCNAME points the CNAME record, if any, at its target.
+func (up *Updater) syncCNAME(ctx context.Context) (changed bool, err error) {
+	target := up.CNAMETarget
+	if target == "" {
+		target = up.domain
+	}
+
+	if up.cname == "" || up.lazy {
+		if err := up.loadCNAME(ctx); err != nil {
+			return false, err
+		}
+	}
+	if strings.EqualFold(up.target, target) {
+		return false, nil
+	}
+	if err := up.updateRecord(ctx, up.cname, target); err != nil {
+		return false, err
+	}
+	up.target = target
+	return true, nil
+}
+
+func (up *Updater) loadCNAME(ctx context.Context) error {
+	recs, _, err := up.api.ListDNSRecords(ctx,
+		cloudflare.ZoneIdentifier(up.zone),
+		cloudflare.ListDNSRecordsParams{Type: "CNAME", Name: up.CNAME})
+	if err != nil {
+		return up.zoneAccess(err)
+	}
+	switch len(recs) {
+	case 0:
+		return fmt.Errorf("%w: %s CNAME", ErrNoRecords, up.CNAME)
+	case 1:
+	default:
+		return fmt.Errorf("%w: %s CNAME", ErrMultipleRecords, up.CNAME)
+	}
+
+	if up.records == nil {
+		up.records = map[string]cloudflare.DNSRecord{}
+	}
+	up.cname = recs[0].ID
+	up.target = recs[0].Content
+	up.records[up.cname] = recs[0]
+	return nil
+}
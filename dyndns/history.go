@@ -0,0 +1,53 @@
+package dyndns
+
+import "time"
+
+// An IPChange is a change of your public IP, observed by an Updater.
+type IPChange struct {
+	Time     time.Time // when the change was observed
+	Network  string    // "ip4" or "ip6"
+	IP       string    // the new IP
+	Previous string    // the previous IP, empty for the first observation
+}
+
+// History returns the changes of your public IP observed by the Updater,
+// oldest first, up to HistorySize of the most recent ones.
+// It's safe to call concurrently with updates.
+func (up *Updater) History() []IPChange {
+	up.mtx.Lock()
+	defer up.mtx.Unlock()
+
+	if len(up.history) < up.HistorySize {
+		return append([]IPChange(nil), up.history...)
+	}
+	// the ring buffer is full: next is the oldest
+	changes := make([]IPChange, 0, len(up.history))
+	changes = append(changes, up.history[up.next:]...)
+	return append(changes, up.history[:up.next]...)
+}
+
+// observe records ip as the current public IP for network.
+func (up *Updater) observe(network, ip string) {
+	if up.HistorySize <= 0 {
+		return
+	}
+	up.mtx.Lock()
+	defer up.mtx.Unlock()
+
+	if up.observed == nil {
+		up.observed = map[string]string{}
+	}
+	prev := up.observed[network]
+	if prev == ip {
+		return
+	}
+	up.observed[network] = ip
+
+	change := IPChange{Time: time.Now(), Network: network, IP: ip, Previous: prev}
+	if len(up.history) < up.HistorySize {
+		up.history = append(up.history, change)
+		return
+	}
+	up.history[up.next] = change
+	up.next = (up.next + 1) % len(up.history)
+}
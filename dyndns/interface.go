@@ -0,0 +1,59 @@
+package dyndns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func (up *Updater) httpClient() *http.Client {
+	if up.Interface == "" {
+		return defaultClient
+	}
+	if up.client == nil {
+		up.client = &http.Client{
+			Timeout: defaultClient.Timeout,
+			Transport: &http.Transport{
+				DialContext: up.dialInterface,
+				// dial every time, as the interface's addresses may change
+				DisableKeepAlives: true,
+			},
+		}
+	}
+	return up.client
+}
+
+// dialInterface dials address from an address of the configured interface,
+// of the same family as address.
+func (up *Updater) dialInterface(ctx context.Context, network, address string) (net.Conn, error) {
+	iface, err := net.InterfaceByName(up.Interface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ipv4 := net.ParseIP(host).To4() != nil
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ipnet.IP.IsGlobalUnicast() && (ipnet.IP.To4() != nil) == ipv4 {
+			var d net.Dialer
+			if strings.HasPrefix(network, "udp") {
+				d.LocalAddr = &net.UDPAddr{IP: ipnet.IP}
+			} else {
+				d.LocalAddr = &net.TCPAddr{IP: ipnet.IP}
+			}
+			return d.DialContext(ctx, network, address)
+		}
+	}
+	return nil, errors.New("no suitable address found on interface " + up.Interface)
+}
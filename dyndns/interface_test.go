@@ -0,0 +1,47 @@
+package dyndns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestUpdater_dialInterface(t *testing.T) {
+	up := Updater{Interface: "missing0"}
+	if _, err := up.dialInterface(context.Background(), "tcp", "192.0.2.1:80"); err == nil {
+		t.Error("missing interface: want error")
+	}
+
+	name, addr := globalInterface(t)
+	if name == "" {
+		t.Skip("no interface with a global IPv4 address")
+	}
+
+	ln, err := net.Listen("tcp4", net.JoinHostPort(addr, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	// the connection is made from the interface's address
+	up = Updater{Interface: name}
+	c, err := up.dialInterface(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.LocalAddr().(*net.TCPAddr).IP.String(); got != addr {
+		t.Errorf("got local address %s, want %s", got, addr)
+	}
+
+	if client := up.httpClient(); client == defaultClient || client.Transport.(*http.Transport).DialContext == nil {
+		t.Error("httpClient doesn't dial through the interface")
+	}
+}
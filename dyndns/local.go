@@ -0,0 +1,74 @@
+package dyndns
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// probe is the public IP last detected for a local outbound address.
+type probe struct {
+	local, public string
+	checked       time.Time
+}
+
+// cachedPublicIP gets your public IP for network,
+// skipping the fetch if the local outbound address is unchanged,
+// and the public IP was confirmed within the ConfirmInterval.
+func (up *Updater) cachedPublicIP(ctx context.Context, network string) (string, error) {
+	return up.cachedPublicIPWith(ctx, network, up.publicIP)
+}
+
+func (up *Updater) cachedPublicIPWith(ctx context.Context, network string, publicIP func(ctx context.Context, network string) (string, error)) (string, error) {
+	if up.ConfirmInterval <= 0 {
+		return publicIP(ctx, network)
+	}
+
+	local, err := up.localIP(ctx, network)
+	if err == nil {
+		p, ok := up.probes[network]
+		if ok && p.local == local && time.Since(p.checked) < up.ConfirmInterval {
+			return p.public, nil
+		}
+	}
+
+	public, err2 := publicIP(ctx, network)
+	if err2 != nil {
+		return "", err2
+	}
+	if err == nil {
+		if up.probes == nil {
+			up.probes = map[string]probe{}
+		}
+		up.probes[network] = probe{local: local, public: public, checked: time.Now()}
+	}
+	return public, nil
+}
+
+// localIP gets the local address used to reach 1.1.1.1 for network, "ip4" or "ip6".
+// Dialing UDP sends no packets.
+func (up *Updater) localIP(ctx context.Context, network string) (string, error) {
+	address := "1.1.1.1:80"
+	if network == "ip6" {
+		address = "[2606:4700:4700::1111]:80"
+	}
+
+	var conn net.Conn
+	var err error
+	if up.Interface != "" {
+		conn, err = up.dialInterface(ctx, "udp", address)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "udp", address)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return "", net.UnknownNetworkError(conn.LocalAddr().Network())
+	}
+	return addr.IP.String(), nil
+}
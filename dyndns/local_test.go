@@ -0,0 +1,77 @@
+package dyndns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUpdater_ConfirmInterval(t *testing.T) {
+	ifaces := []string{""}
+	name, addr := globalInterface(t)
+	if name != "" {
+		ifaces = append(ifaces, name)
+	}
+
+	for _, iface := range ifaces {
+		up := Updater{Interface: iface, ConfirmInterval: time.Hour}
+		ctx := context.Background()
+
+		local, err := up.localIP(ctx, "ip4")
+		if iface == "" && err != nil {
+			t.Skip(err) // no IPv4 route
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", iface, err)
+		}
+		if iface != "" && local != addr {
+			t.Errorf("%s: got local address %s, want %s", iface, local, addr)
+		}
+
+		var fetches int
+		fetch := func(ctx context.Context, network string) (string, error) {
+			fetches++
+			return "198.51.100.1", nil
+		}
+		for i := 0; i < 2; i++ {
+			ip, err := up.cachedPublicIPWith(ctx, "ip4", fetch)
+			if err != nil || ip != "198.51.100.1" {
+				t.Errorf("%q: got %q, %v", iface, ip, err)
+			}
+		}
+		if fetches != 1 {
+			t.Errorf("%q: fetched %d times, want 1", iface, fetches)
+		}
+
+		// the public IP is confirmed once per interval
+		p := up.probes["ip4"]
+		p.checked = time.Now().Add(-up.ConfirmInterval)
+		up.probes["ip4"] = p
+		up.cachedPublicIPWith(ctx, "ip4", fetch)
+		if fetches != 2 {
+			t.Errorf("%q: fetched %d times, want 2", iface, fetches)
+		}
+	}
+}
+
+// globalInterface finds an interface with a global unicast IPv4 address,
+// returning empty strings if there's none.
+func globalInterface(t *testing.T) (name, addr string) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.IsGlobalUnicast() && n.IP.To4() != nil {
+				return iface.Name, n.IP.String()
+			}
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,114 @@
+package dyndns
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// A Domain identifies the A/AAAA records of a domain in a Cloudflare zone.
+type Domain struct {
+	Name  string // the domain name
+	Zone  string // the zone ID
+	Token string // a token with Zone.DNS permission; if empty, the shared token is used
+}
+
+// MultiUpdater updates the A/AAAA DNS records of several domains,
+// possibly in different zones, to your current public IP.
+//
+// Your public IP is detected once for all domains.
+// Configure a MultiUpdater by setting its fields before calling its methods.
+type MultiUpdater struct {
+	// Updaters update the records of each domain.
+	// Their Network and DryRun fields can be configured individually;
+	// their Interface is ignored.
+	Updaters []*Updater
+
+	// Interface, if set, is the name of the network interface
+	// used to detect your public IP.
+	Interface string
+
+	// Jitter randomizes the polling interval of Sync by up to this fraction.
+	Jitter float64
+
+	detect Updater
+}
+
+// NewMultiUpdater creates a MultiUpdater for domains,
+// using token for domains that don't have their own.
+func NewMultiUpdater(token string, domains ...Domain) (*MultiUpdater, error) {
+	var multi MultiUpdater
+	for _, d := range domains {
+		tok := d.Token
+		if tok == "" {
+			tok = token
+		}
+		up, err := NewUpdater(d.Name, d.Zone, tok)
+		if err != nil {
+			return nil, &DomainError{Domain: d.Name, Err: err}
+		}
+		multi.Updaters = append(multi.Updaters, up)
+	}
+	return &multi, nil
+}
+
+// Update updates the DNS records of all domains to your current public IP.
+// Failing to update a domain doesn't stop the others:
+// errors are aggregated, one per domain.
+func (m *MultiUpdater) Update() error {
+	return m.UpdateContext(context.Background())
+}
+
+// UpdateContext is like Update, but cancels when ctx is done.
+func (m *MultiUpdater) UpdateContext(ctx context.Context) error {
+	m.detect.Interface = m.Interface
+
+	// detect each IP once
+	type result struct {
+		ip  string
+		err error
+	}
+	results := map[string]result{}
+	publicIP := func(ctx context.Context, network string) (string, error) {
+		r, ok := results[network]
+		if !ok {
+			r.ip, r.err = m.detect.publicIP(ctx, network)
+			results[network] = r
+		}
+		return r.ip, r.err
+	}
+
+	var errs []error
+	for _, up := range m.Updaters {
+		if _, err := up.updateRecordsWith(ctx, publicIP); err != nil {
+			errs = append(errs, &DomainError{Domain: up.domain, Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sync enters a loop keeping the DNS records of all domains up to date with your current public IP.
+//
+// After consecutive failures, polling backs off exponentially, up to an hour.
+func (m *MultiUpdater) Sync(polling time.Duration) error {
+	var failures int
+	for {
+		if err := m.Update(); err != nil {
+			log.Println("failed to update DNS records:", err)
+			failures++
+		} else {
+			failures = 0
+		}
+		time.Sleep(jitter(backoff(polling, failures), m.Jitter))
+	}
+}
+
+// A DomainError is an error updating the records of a domain.
+type DomainError struct {
+	Domain string
+	Err    error
+}
+
+func (e *DomainError) Error() string { return e.Domain + ": " + e.Err.Error() }
+func (e *DomainError) Unwrap() error { return e.Err }
@@ -0,0 +1,66 @@
+package dyndns
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// Config configures Run.
+type Config struct {
+	Domain  string        // the domain name
+	Zone    string        // the zone ID
+	Token   string        // a token with Zone.DNS permission
+	Polling time.Duration // the polling interval; if zero, 5 minutes
+
+	// Configure, if set, configures the Updater before it's first used
+	// (e.g. setting its Network, or StateFile).
+	Configure func(*Updater)
+
+	// Signals, if set, trigger an immediate update (e.g. syscall.SIGHUP),
+	// for when the IP is known to have changed.
+	Signals []os.Signal
+}
+
+// Run keeps the A/AAAA DNS records of a domain up to date with your current public IP,
+// updating them immediately, then polling until ctx is done, when it returns nil.
+// The polling interval is randomized by ±10%, as with SyncDNS.
+//
+// Usage, stopping cleanly on SIGTERM:
+//
+//	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+//	defer stop()
+//	log.Fatal(dyndns.Run(ctx, dyndns.Config{Domain: "[DOMAIN]", Zone: "[ZONE ID]", Token: "[TOKEN]"}))
+func Run(ctx context.Context, config Config) error {
+	up, err := NewUpdater(config.Domain, config.Zone, config.Token)
+	if err != nil {
+		return err
+	}
+	up.Jitter = 0.1
+	if config.Configure != nil {
+		config.Configure(up)
+	}
+
+	if len(config.Signals) > 0 {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, config.Signals...)
+		defer signal.Stop(sig)
+		go func() {
+			for {
+				select {
+				case <-sig:
+					up.Trigger()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	polling := config.Polling
+	if polling == 0 {
+		polling = 5 * time.Minute
+	}
+	return up.SyncContext(ctx, polling)
+}
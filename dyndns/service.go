@@ -25,8 +25,12 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/cloudflare-go"
@@ -34,87 +38,384 @@ import (
 
 // UpdateDNS updates A/AAAA DNS records to your current public IP.
 func UpdateDNS(domain, zone, token string) error {
-	up, err := newUpdater(domain, zone, token)
+	up, err := NewUpdater(domain, zone, token)
 	if err != nil {
 		return err
 	}
-	return up.updateRecords()
+	return up.Update()
+}
+
+// UpdateDNSChanged is like UpdateDNS, but also reports whether any record changed,
+// and the IPs the A/AAAA records point to.
+func UpdateDNSChanged(domain, zone, token string) (changed bool, ipv4, ipv6 string, err error) {
+	up, err := NewUpdater(domain, zone, token)
+	if err != nil {
+		return false, "", "", err
+	}
+	return up.UpdateChanged()
 }
 
 // SyncDNS enters a loop keeping A/AAAA DNS records up to date with your current public IP.
+//
+// The polling interval is randomized by ±10%,
+// so instances started together don't call the API in lockstep.
 func SyncDNS(domain, zone, token string, polling time.Duration) error {
-	up, err := newUpdater(domain, zone, token)
+	up, err := NewUpdater(domain, zone, token)
 	if err != nil {
 		return err
 	}
-	for {
-		if err := up.updateRecords(); err != nil {
-			log.Println("failed to update DNS records:", err)
-		}
-		time.Sleep(polling)
-	}
+	up.Jitter = 0.1
+	return up.Sync(polling)
 }
 
+// Errors returned by the Updater, for errors.Is.
+var (
+	ErrMultipleRecords = errors.New("multiple records found")         // the domain has more than one A (or AAAA) record
+	ErrNoRecords       = errors.New("no records found")               // the domain has neither A nor AAAA records (or the CNAME doesn't exist)
+	ErrParse           = errors.New("parse error")                    // the public IP service sent an unexpected response
+	ErrInvalidToken    = errors.New("invalid API token")              // the token is invalid, expired, or disabled
+	ErrZoneAccess      = errors.New("can't list DNS records of zone") // the token has no Zone.DNS permission for the zone
+	ErrCGNAT           = errors.New("behind carrier-grade NAT")       // the public IP likely doesn't route back (see RefuseCGNAT)
+)
+
 var defaultClient = &http.Client{Timeout: 5 * time.Second}
 
-type updater struct {
+// Updater updates the A/AAAA DNS records of a domain to your current public IP.
+//
+// Configure an Updater by setting its fields before calling its methods.
+type Updater struct {
+	// Network selects which records to update:
+	// "ip4" for A records only, "ip6" for AAAA records only,
+	// or "ip" (or empty) for both.
+	//
+	// On dual-stack hosts with temporary IPv6 addresses,
+	// "ip4" prevents the AAAA record from flapping whenever the address rotates.
+	Network string
+
+	// Interface, if set, is the name of the network interface
+	// used to detect your public IP (e.g. the WAN link, rather than a VPN).
+	Interface string
+
+	// Jitter randomizes the polling interval of Sync by up to this fraction
+	// (e.g. 0.1 for ±10%), to spread out API calls across instances.
+	// Zero disables jitter.
+	Jitter float64
+
+	// DryRun, if set, logs the changes that would be made to DNS records,
+	// instead of making them.
+	DryRun bool
+
+	// StateFile, if set, is where the last synced IPs are saved,
+	// along with the IDs of their records.
+	// After a restart, saved IPs for the same records are assumed current,
+	// so an unchanged IP makes no API calls to update records.
+	StateFile string
+
+	// ConfirmInterval, if set, reduces fetches of your public IP:
+	// while the local outbound address (the one used to reach 1.1.1.1) is unchanged,
+	// the public IP is only fetched once per interval, to confirm the NAT mapping.
+	// This suits always-on hosts with stable IPs.
+	ConfirmInterval time.Duration
+
+	// HistorySize, if set, is how many changes of your public IP History keeps.
+	// This helps correlate downtime with IP changes.
+	HistorySize int
+
+	// MinWriteInterval, if set, is the minimum time between writes to each A/AAAA record.
+	// If your public IP changes again sooner (e.g. a flapping connection),
+	// the record is updated on the first update after the interval,
+	// to avoid a storm of DNS updates.
+	MinWriteInterval time.Duration
+
+	// RefuseCGNAT, if set, refuses to publish an IPv4 that likely doesn't route back to this host,
+	// failing updates with ErrCGNAT: if either the public IP, or the local outbound address,
+	// is in the shared address space of carrier-grade NAT (100.64.0.0/10);
+	// or if the public IP isn't a public unicast address.
+	RefuseCGNAT bool
+
+	// CNAME, if set, is the name of a CNAME record, in the same zone,
+	// that's kept pointing at CNAMETarget (or the domain, if empty),
+	// e.g. an alias for the dynamic host, in a hybrid setup.
+	// The record must already exist.
+	CNAME, CNAMETarget string
+
+	client     *http.Client
 	api        *cloudflare.API
+	domain     string
 	zone       string
 	a, aaaa    string
 	ipv4, ipv6 string
+	cname      string
+	target     string
+	saved      state
+	loaded     bool
+	records    map[string]cloudflare.DNSRecord
+	probes     map[string]probe
+	observed   map[string]string
+	history    []IPChange
+	next       int
+	lazy       bool
+	mtx        sync.Mutex
+	status     Status
+	trigger    chan struct{}
+	writes     map[string]time.Time
+}
+
+// NewUpdater creates an Updater for the A/AAAA DNS records of domain,
+// given the zone ID and a token with Zone.DNS permission.
+//
+// The records are listed, so that misconfigured tokens fail here
+// (with ErrZoneAccess, or ErrInvalidToken if the token is known to be inactive),
+// rather than on the first update.
+// Edit permission can't be verified without editing a record.
+func NewUpdater(domain, zone, token string) (*Updater, error) {
+	api, err := cloudflare.NewWithAPIToken(token, cloudflare.HTTPClient(defaultClient))
+	if err != nil {
+		return nil, err
+	}
+	return newUpdater(context.Background(), api, domain, zone)
 }
 
-func newUpdater(domain, zone, token string) (*updater, error) {
+// NewLazyUpdater is like NewUpdater, but doesn't load the records up front,
+// nor check the token.
+// Instead, each update lists the domain's A/AAAA records, filtered by Network.
+//
+// This tolerates records created (or recreated) after the Updater,
+// at the cost of an extra API call per update.
+func NewLazyUpdater(domain, zone, token string) (*Updater, error) {
 	api, err := cloudflare.NewWithAPIToken(token, cloudflare.HTTPClient(defaultClient))
 	if err != nil {
 		return nil, err
 	}
+	return &Updater{api: api, zone: zone, domain: domain, lazy: true}, nil
+}
+
+// NewUpdaterWithClient creates an Updater for the A/AAAA DNS records of domain,
+// given the zone ID and an API instance with a token with Zone.DNS permission.
+//
+// This allows a preconfigured client, e.g. with a custom base URL, retry policy, or proxy.
+func NewUpdaterWithClient(api *cloudflare.API, domain, zone string) (*Updater, error) {
+	return newUpdater(context.Background(), api, domain, zone)
+}
 
-	up := updater{api: api, zone: zone}
+func newUpdater(ctx context.Context, api *cloudflare.API, domain, zone string) (*Updater, error) {
+	up := Updater{api: api, zone: zone, domain: domain}
 
-	if err := up.loadRecords(domain); err != nil {
+	// fail fast on misconfigured tokens
+	if err := up.loadRecords(ctx, domain); err != nil {
+		// explain the failure, if it's an inactive token;
+		// this is best-effort: account tokens and API keys can't be verified
+		if res, e := api.VerifyAPIToken(ctx); e == nil && res.Status != "active" {
+			return nil, fmt.Errorf("%w: status %s: %w", ErrInvalidToken, res.Status, err)
+		}
 		return nil, err
 	}
 
+	up.setStatus(time.Time{}, nil)
 	return &up, nil
 }
 
-func (up *updater) loadRecords(domain string) error {
-	recs, _, err := up.api.ListDNSRecords(context.Background(),
-		cloudflare.ZoneIdentifier(up.zone),
-		cloudflare.ListDNSRecordsParams{Name: domain})
-	if err != nil {
-		return err
+// Update updates the DNS records to your current public IP.
+func (up *Updater) Update() error {
+	return up.UpdateContext(context.Background())
+}
+
+// UpdateContext is like Update, but cancels when ctx is done.
+func (up *Updater) UpdateContext(ctx context.Context) error {
+	_, err := up.updateRecords(ctx)
+	return err
+}
+
+// UpdateChanged is like Update, but also reports whether any record changed,
+// and the IPs the A/AAAA records point to (empty if there's no such record).
+func (up *Updater) UpdateChanged() (changed bool, ipv4, ipv6 string, err error) {
+	changed, err = up.updateRecords(context.Background())
+	return changed, up.ipv4, up.ipv6, err
+}
+
+// Sync enters a loop keeping the DNS records up to date with your current public IP.
+//
+// After consecutive failures, polling backs off exponentially, up to an hour.
+func (up *Updater) Sync(polling time.Duration) error {
+	return up.SyncContext(context.Background(), polling)
+}
+
+// SyncContext is like Sync, but returns nil when ctx is done.
+func (up *Updater) SyncContext(ctx context.Context, polling time.Duration) error {
+	var failures int
+	for {
+		if _, err := up.updateRecords(ctx); err != nil && ctx.Err() == nil {
+			log.Println("failed to update DNS records:", err)
+			failures++
+		} else {
+			failures = 0
+		}
+
+		timer := time.NewTimer(jitter(backoff(polling, failures), up.Jitter))
+		select {
+		case <-timer.C:
+		case <-up.triggered():
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// Trigger makes Sync (or SyncContext) update the records now,
+// rather than at the next poll, and restarts the polling interval.
+// This is useful when the IP is known to have changed (e.g. a PPP link came up).
+// It doesn't block, and triggers made during an update are coalesced.
+func (up *Updater) Trigger() {
+	select {
+	case up.triggered() <- struct{}{}:
+	default:
+	}
+}
+
+func (up *Updater) triggered() chan struct{} {
+	up.mtx.Lock()
+	defer up.mtx.Unlock()
+	if up.trigger == nil {
+		up.trigger = make(chan struct{}, 1)
+	}
+	return up.trigger
+}
+
+// backoff doubles polling for each consecutive failure,
+// up to an hour (or polling, if longer).
+func backoff(polling time.Duration, failures int) time.Duration {
+	limit := time.Hour
+	if polling > limit {
+		return polling
+	}
+	d := polling
+	for i := 0; i < failures && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		return limit
+	}
+	return d
+}
+
+func jitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 {
+		return d
 	}
+	return d + time.Duration(float64(d)*frac*(2*rand.Float64()-1))
+}
 
+// zoneAccess wraps err with ErrZoneAccess, if the API refused the token.
+func (up *Updater) zoneAccess(err error) error {
+	var cferr *cloudflare.Error
+	if errors.As(err, &cferr) && (cferr.StatusCode == http.StatusUnauthorized || cferr.StatusCode == http.StatusForbidden) {
+		return fmt.Errorf("%w %s: %w", ErrZoneAccess, up.zone, err)
+	}
+	return err
+}
+
+func (up *Updater) loadRecords(ctx context.Context, domain string) error {
+	// fetch all pages explicitly
+	var recs []cloudflare.DNSRecord
+	params := cloudflare.ListDNSRecordsParams{Name: domain}
+	switch up.Network {
+	case "ip4":
+		params.Type = "A"
+	case "ip6":
+		params.Type = "AAAA"
+	}
+	params.Page, params.PerPage = 1, 100
+	for {
+		page, info, err := up.api.ListDNSRecords(ctx,
+			cloudflare.ZoneIdentifier(up.zone), params)
+		if err != nil {
+			return up.zoneAccess(err)
+		}
+		recs = append(recs, page...)
+		if info == nil || !info.HasMorePages() {
+			break
+		}
+		params.Page = info.Page + 1
+	}
+
+	up.a, up.aaaa = "", ""
+	up.records = map[string]cloudflare.DNSRecord{}
 	for i := range recs {
 		switch recs[i].Type {
 		case "A":
 			if up.a != "" {
-				return errors.New("Multiple A records found for " + domain)
+				return fmt.Errorf("%w: %s A", ErrMultipleRecords, domain)
 			}
 			up.a = recs[i].ID
 			up.ipv4 = recs[i].Content
+			up.records[up.a] = recs[i]
 		case "AAAA":
 			if up.aaaa != "" {
-				return errors.New("Multiple AAAA records found for " + domain)
+				return fmt.Errorf("%w: %s AAAA", ErrMultipleRecords, domain)
 			}
 			up.aaaa = recs[i].ID
 			up.ipv6 = recs[i].Content
+			up.records[up.aaaa] = recs[i]
 		}
 	}
 	if up.a == "" && up.aaaa == "" {
-		return errors.New("No A/AAAA records found for " + domain)
+		return fmt.Errorf("%w: %s A/AAAA", ErrNoRecords, domain)
 	}
 
 	return nil
 }
 
-func (up *updater) updateRecords() (err error) {
-	if up.a != "" {
-		ip, e := PublicIPv4()
+func (up *Updater) updateRecords(ctx context.Context) (changed bool, err error) {
+	return up.updateRecordsWith(ctx, up.cachedPublicIP)
+}
+
+// publicIP gets your public IP for network, "ip4" or "ip6".
+func (up *Updater) publicIP(ctx context.Context, network string) (string, error) {
+	if network == "ip4" {
+		return publicIPv4(ctx, up.httpClient())
+	}
+	return publicIPv6(ctx, up.httpClient())
+}
+
+func (up *Updater) updateRecordsWith(ctx context.Context, publicIP func(ctx context.Context, network string) (string, error)) (changed bool, err error) {
+	defer func() { up.setStatus(time.Now(), err) }()
+
+	switch up.Network {
+	case "", "ip", "ip4", "ip6":
+	default:
+		return false, net.UnknownNetworkError(up.Network)
+	}
+
+	if up.lazy {
+		if err := up.loadRecords(ctx, up.domain); err != nil {
+			return false, err
+		}
+	}
+
+	if up.StateFile != "" && !up.loaded {
+		if err := up.loadState(); err != nil {
+			return false, err
+		}
+		up.loaded = true
+	}
+
+	if up.a != "" && up.Network != "ip6" {
+		ip, e := publicIP(ctx, "ip4")
+		if e == nil && up.RefuseCGNAT {
+			e = up.checkCGNAT(ctx, ip)
+		}
+		if e == nil {
+			up.observe("ip4", ip)
+		}
 		if e == nil && ip != up.ipv4 {
-			e = up.updateRecord(up.a, ip)
+			if up.debounce(up.a, ip) {
+				ip = up.ipv4 // retry on the next update
+			} else {
+				e = up.updateRecord(ctx, up.a, ip)
+				changed = changed || e == nil
+			}
 		}
 		if e == nil {
 			up.ipv4 = ip
@@ -123,10 +424,18 @@ func (up *updater) updateRecords() (err error) {
 		}
 	}
 
-	if up.aaaa != "" {
-		ip, e := PublicIPv6()
+	if up.aaaa != "" && up.Network != "ip4" {
+		ip, e := publicIP(ctx, "ip6")
+		if e == nil {
+			up.observe("ip6", ip)
+		}
 		if e == nil && ip != up.ipv6 {
-			e = up.updateRecord(up.aaaa, ip)
+			if up.debounce(up.aaaa, ip) {
+				ip = up.ipv6 // retry on the next update
+			} else {
+				e = up.updateRecord(ctx, up.aaaa, ip)
+				changed = changed || e == nil
+			}
 		}
 		if e == nil {
 			up.ipv6 = ip
@@ -135,39 +444,113 @@ func (up *updater) updateRecords() (err error) {
 		}
 	}
 
+	if up.CNAME != "" {
+		c, e := up.syncCNAME(ctx)
+		changed = changed || c
+		if e != nil {
+			err = e
+		}
+	}
+
+	if up.StateFile != "" && !up.DryRun {
+		if e := up.saveState(); e != nil {
+			err = e
+		}
+	}
 	return
 }
 
-func (up *updater) updateRecord(record, content string) error {
-	_, err := up.api.UpdateDNSRecord(context.Background(),
+func (up *Updater) updateRecord(ctx context.Context, record, content string) error {
+	if up.DryRun {
+		log.Printf("dry run: would PATCH record %s to %s", record, content)
+		up.wrote(record)
+		return nil
+	}
+	_, err := up.api.UpdateDNSRecord(ctx,
 		cloudflare.ZoneIdentifier(up.zone),
-		cloudflare.UpdateDNSRecordParams{
-			ID:      record,
-			Content: content,
-		})
+		up.updateParams(record, content))
+	if err == nil {
+		up.wrote(record)
+	}
 	return err
 }
 
+// debounce reports whether writing content to record should wait,
+// because the record was written less than MinWriteInterval ago.
+func (up *Updater) debounce(record, content string) bool {
+	last, ok := up.writes[record]
+	if !ok || up.MinWriteInterval <= 0 {
+		return false
+	}
+	if wait := up.MinWriteInterval - time.Since(last); wait > 0 {
+		log.Printf("deferring update of record %s to %s for %v", record, content, wait.Round(time.Second))
+		return true
+	}
+	return false
+}
+
+func (up *Updater) wrote(record string) {
+	if up.writes == nil {
+		up.writes = map[string]time.Time{}
+	}
+	up.writes[record] = time.Now()
+}
+
+// updateParams carries over the record's other attributes,
+// so updating its content never changes them (e.g. the proxied status).
+func (up *Updater) updateParams(record, content string) cloudflare.UpdateDNSRecordParams {
+	params := cloudflare.UpdateDNSRecordParams{
+		ID:      record,
+		Content: content,
+	}
+	if rec, ok := up.records[record]; ok {
+		params.Type = rec.Type
+		params.Name = rec.Name
+		params.TTL = rec.TTL
+		params.Proxied = rec.Proxied
+		params.Tags = rec.Tags
+	}
+	return params
+}
+
 // PublicIPv4 gets your public v4 IP.
 func PublicIPv4() (string, error) {
-	return publicIP("1.1.1.1", "1.0.0.1")
+	return PublicIPv4Context(context.Background())
 }
 
 // PublicIPv6 gets your public v6 IP.
 func PublicIPv6() (string, error) {
-	return publicIP("[2606:4700:4700::1111]", "[2606:4700:4700::1001]")
+	return PublicIPv6Context(context.Background())
 }
 
-func publicIP(primary, secondary string) (string, error) {
-	ip, err := tryGetIP("https://" + primary + "/cdn-cgi/trace")
-	if err != nil {
-		return tryGetIP("https://" + secondary + "/cdn-cgi/trace")
+// PublicIPv4Context is like PublicIPv4, but cancels when ctx is done.
+func PublicIPv4Context(ctx context.Context) (string, error) {
+	return publicIPv4(ctx, defaultClient)
+}
+
+// PublicIPv6Context is like PublicIPv6, but cancels when ctx is done.
+func PublicIPv6Context(ctx context.Context) (string, error) {
+	return publicIPv6(ctx, defaultClient)
+}
+
+func publicIPv4(ctx context.Context, client *http.Client) (string, error) {
+	return publicIP(ctx, client, "ip4", "1.1.1.1", "1.0.0.1")
+}
+
+func publicIPv6(ctx context.Context, client *http.Client) (string, error) {
+	return publicIP(ctx, client, "ip6", "[2606:4700:4700::1111]", "[2606:4700:4700::1001]")
+}
+
+func publicIP(ctx context.Context, client *http.Client, network, primary, secondary string) (string, error) {
+	ip, err := tryGetIP(ctx, client, network, "https://"+primary+"/cdn-cgi/trace")
+	if err != nil && ctx.Err() == nil {
+		return tryGetIP(ctx, client, network, "https://"+secondary+"/cdn-cgi/trace")
 	}
 	return ip, err
 }
 
-func tryGetIP(url string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+func tryGetIP(ctx context.Context, client *http.Client, network, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
@@ -175,7 +558,7 @@ func tryGetIP(url string) (string, error) {
 		return "", err
 	}
 
-	res, err := defaultClient.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -189,11 +572,26 @@ func tryGetIP(url string) (string, error) {
 	for scanner.Scan() {
 		const prefix = "ip="
 		if bytes.HasPrefix(scanner.Bytes(), []byte(prefix)) {
-			return scanner.Text()[len(prefix):], nil
+			return parseIP(network, scanner.Text()[len(prefix):])
 		}
 	}
 	if err := scanner.Err(); err != nil {
 		return "", err
 	}
-	return "", errors.New("parse error: ip not found")
+	return "", fmt.Errorf("%w: ip not found", ErrParse)
+}
+
+// parseIP validates that s is an IP of the expected network family,
+// and returns it in canonical form.
+func parseIP(network, s string) (string, error) {
+	ip := net.ParseIP(s)
+	switch {
+	case ip == nil:
+		return "", fmt.Errorf("%w: invalid ip %q", ErrParse, s)
+	case network == "ip4" && ip.To4() == nil:
+		return "", fmt.Errorf("%w: not an IPv4 %q", ErrParse, s)
+	case network == "ip6" && ip.To4() != nil:
+		return "", fmt.Errorf("%w: not an IPv6 %q", ErrParse, s)
+	}
+	return ip.String(), nil
 }
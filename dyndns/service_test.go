@@ -1,7 +1,19 @@
 package dyndns
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
 )
 
 func TestGetIPs(t *testing.T) {
@@ -17,3 +29,595 @@ func TestGetIPs(t *testing.T) {
 		t.Log(ipv6)
 	}
 }
+
+func TestPublicIPContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, get := range []func(context.Context) (string, error){PublicIPv4Context, PublicIPv6Context} {
+		if _, err := get(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+	}
+}
+
+func Test_parseIP(t *testing.T) {
+	tests := []struct {
+		network, in, want string
+		err               bool
+	}{
+		{"ip4", "1.2.3.4", "1.2.3.4", false},
+		{"ip6", "2001:DB8:0:0::1", "2001:db8::1", false},
+		{"ip4", "2001:db8::1", "", true},
+		{"ip6", "1.2.3.4", "", true},
+		{"ip4", "1.2.3.4<html>", "", true},
+		{"ip4", "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseIP(tt.network, tt.in)
+		if got != tt.want || (err != nil) != tt.err || err != nil && !errors.Is(err, ErrParse) {
+			t.Errorf("parseIP(%q, %q) = %q, %v", tt.network, tt.in, got, err)
+		}
+	}
+}
+
+func Test_jitter(t *testing.T) {
+	if got := jitter(time.Minute, 0); got != time.Minute {
+		t.Errorf("jitter(1m, 0) = %v", got)
+	}
+	for i := 0; i < 100; i++ {
+		if got := jitter(time.Minute, 0.1); got < 54*time.Second || got > 66*time.Second {
+			t.Errorf("jitter(1m, 0.1) = %v", got)
+		}
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	tests := []struct {
+		polling  time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{time.Minute, 0, time.Minute},
+		{time.Minute, 1, 2 * time.Minute},
+		{time.Minute, 3, 8 * time.Minute},
+		{time.Minute, 100, time.Hour},
+		{2 * time.Hour, 5, 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.polling, tt.failures); got != tt.want {
+			t.Errorf("backoff(%v, %d) = %v, want %v", tt.polling, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestUpdater_state(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+
+	up := Updater{StateFile: file, a: "rec-a", aaaa: "rec-aaaa", ipv4: "192.0.2.1", ipv6: "2001:db8::1"}
+	if err := up.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	// same records: the saved IPs are trusted
+	up = Updater{StateFile: file, a: "rec-a", aaaa: "rec-aaaa", ipv4: "192.0.2.2"}
+	if err := up.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if up.ipv4 != "192.0.2.1" || up.ipv6 != "2001:db8::1" {
+		t.Errorf("got %q, %q", up.ipv4, up.ipv6)
+	}
+
+	// different records: the state is stale
+	up = Updater{StateFile: file, a: "rec-b", ipv4: "192.0.2.2"}
+	if err := up.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if up.ipv4 != "192.0.2.2" {
+		t.Errorf("got %q", up.ipv4)
+	}
+
+	// no state file
+	up = Updater{StateFile: file + ".missing"}
+	if err := up.loadState(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdater_updateParams(t *testing.T) {
+	proxied := true
+	up := Updater{records: map[string]cloudflare.DNSRecord{
+		"rec": {ID: "rec", Type: "A", Name: "example.com", TTL: 1, Proxied: &proxied, Tags: []string{"tag"}},
+	}}
+
+	params := up.updateParams("rec", "192.0.2.1")
+	if params.ID != "rec" || params.Content != "192.0.2.1" ||
+		params.Type != "A" || params.Name != "example.com" || params.TTL != 1 ||
+		params.Proxied == nil || !*params.Proxied || len(params.Tags) != 1 {
+		t.Errorf("got %+v", params)
+	}
+}
+
+func TestMultiUpdater_Update(t *testing.T) {
+	multi := MultiUpdater{Updaters: []*Updater{
+		{domain: "a.example.com", Network: "tcp"},
+		{domain: "b.example.com", Network: "udp"},
+	}}
+
+	err := multi.Update()
+	var derr *DomainError
+	if !errors.As(err, &derr) || derr.Domain != "a.example.com" {
+		t.Fatalf("got %v", err)
+	}
+	if got := err.Error(); got != "a.example.com: unknown network tcp\nb.example.com: unknown network udp" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestUpdater_loadRecords(t *testing.T) {
+	// one record per page
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+		rec := `{"id":"rec-a","type":"A","content":"192.0.2.1"}`
+		if page == "2" {
+			rec = `{"id":"rec-aaaa","type":"AAAA","content":"2001:db8::1"}`
+		}
+		fmt.Fprintf(w, `{"success":true,"result":[%s],"result_info":{"page":%s,"per_page":1,"count":1,"total_count":2,"total_pages":2}}`, rec, page)
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := Updater{api: api, zone: "zone"}
+	if err := up.loadRecords(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if up.a != "rec-a" || up.aaaa != "rec-aaaa" || up.ipv4 != "192.0.2.1" || up.ipv6 != "2001:db8::1" {
+		t.Errorf("got %+v", &up)
+	}
+}
+
+func TestUpdater_noRecords(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"success":true,"result":[]}`)
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL), cloudflare.UsingRateLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := Updater{api: api, zone: "zone", CNAME: "www.example.com"}
+	if err := up.loadRecords(context.Background(), "example.com"); !errors.Is(err, ErrNoRecords) {
+		t.Errorf("A/AAAA: got %v, want %v", err, ErrNoRecords)
+	}
+	if err := up.loadCNAME(context.Background()); !errors.Is(err, ErrNoRecords) {
+		t.Errorf("CNAME: got %v, want %v", err, ErrNoRecords)
+	}
+}
+
+func TestUpdater_lazy(t *testing.T) {
+	var types []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		types = append(types, r.URL.Query().Get("type"))
+		io.WriteString(w, `{"success":true,"result":[{"id":"rec-a","type":"A","content":"192.0.2.1"}]}`)
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := Updater{api: api, zone: "zone", domain: "example.com", lazy: true, Network: "ip4", DryRun: true}
+	publicIP := func(ctx context.Context, network string) (string, error) { return "192.0.2.2", nil }
+	for i := 0; i < 2; i++ {
+		changed, err := up.updateRecordsWith(context.Background(), publicIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the record is reloaded, so it's still stale
+		if !changed || up.ipv4 != "192.0.2.2" {
+			t.Errorf("got %v, %q", changed, up.ipv4)
+		}
+	}
+	if len(types) != 2 || types[0] != "A" {
+		t.Errorf("got %q", types)
+	}
+}
+
+func TestUpdater_History(t *testing.T) {
+	var up Updater
+	up.observe("ip4", "192.0.2.1")
+	if h := up.History(); len(h) != 0 {
+		t.Errorf("disabled: got %v", h)
+	}
+
+	up.HistorySize = 2
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		up.observe("ip4", ip)
+	}
+	h := up.History()
+	if len(h) != 2 || h[0].IP != "192.0.2.2" || h[0].Previous != "192.0.2.1" || h[1].IP != "192.0.2.3" {
+		t.Errorf("got %+v", h)
+	}
+
+	// safe to read during updates
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			up.observe("ip6", fmt.Sprintf("2001:db8::%x", i))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		up.History()
+	}
+	<-done
+}
+
+func TestNewUpdaterWithClient(t *testing.T) {
+	tests := []struct {
+		status string
+		code   int
+		want   error
+	}{
+		{"active", http.StatusOK, nil},
+		{"", http.StatusOK, nil}, // account tokens and API keys fail verification
+		{"disabled", http.StatusForbidden, ErrInvalidToken},
+		{"active", http.StatusForbidden, ErrZoneAccess},
+		{"", http.StatusForbidden, ErrZoneAccess},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/user/tokens/verify" {
+				if tt.status == "" {
+					w.WriteHeader(http.StatusUnauthorized)
+					io.WriteString(w, `{"success":false,"errors":[{"code":1000,"message":"Invalid API Token"}]}`)
+					return
+				}
+				fmt.Fprintf(w, `{"success":true,"result":{"id":"tok","status":%q}}`, tt.status)
+				return
+			}
+			w.WriteHeader(tt.code)
+			io.WriteString(w, `{"success":true,"result":[{"id":"rec-a","type":"A","content":"192.0.2.1"}]}`)
+		}))
+
+		api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewUpdaterWithClient(api, "example.com", "zone")
+		if !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) {
+			t.Errorf("%s, %d: got %v, want %v", tt.status, tt.code, err, tt.want)
+		}
+		srv.Close()
+	}
+}
+
+func TestUpdater_zoneAccess(t *testing.T) {
+	var code int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+		io.WriteString(w, `{"success":false,"errors":[{"code":1000,"message":"error"}]}`)
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL), cloudflare.UsingRateLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := Updater{api: api, zone: "zone", CNAME: "www.example.com"}
+
+	// only authorization failures are wrapped
+	for _, code = range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusBadRequest} {
+		want := code == http.StatusUnauthorized || code == http.StatusForbidden
+		for _, err := range []error{up.loadRecords(context.Background(), "example.com"), up.loadCNAME(context.Background())} {
+			if err == nil || errors.Is(err, ErrZoneAccess) != want {
+				t.Errorf("%d: got %v", code, err)
+			}
+		}
+	}
+}
+
+func TestUpdater_SyncContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	up := Updater{Network: "tcp"} // fails every update
+
+	done := make(chan error)
+	go func() { done <- up.SyncContext(ctx, time.Hour) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("didn't return")
+	}
+}
+
+func TestUpdater_Status(t *testing.T) {
+	up := Updater{a: "rec-a", DryRun: true}
+	if s := up.Status(); s.A != "" || !s.LastSync.IsZero() {
+		t.Errorf("before update: got %+v", s)
+	}
+
+	fail := errors.New("unreachable")
+	publicIP := func(ctx context.Context, network string) (string, error) { return "", fail }
+	if _, err := up.updateRecordsWith(context.Background(), publicIP); err == nil {
+		t.Fatal("want error")
+	}
+	s := up.Status()
+	if s.A != "rec-a" || s.LastSync.IsZero() || s.LastError != fail {
+		t.Errorf("got %+v", s)
+	}
+	if str := s.String(); !strings.Contains(str, "A rec-a = none") || !strings.Contains(str, "unreachable") {
+		t.Errorf("got %q", str)
+	}
+
+	publicIP = func(ctx context.Context, network string) (string, error) { return "192.0.2.1", nil }
+	if _, err := up.updateRecordsWith(context.Background(), publicIP); err != nil {
+		t.Fatal(err)
+	}
+	if s := up.Status(); s.IPv4 != "192.0.2.1" || s.LastError != nil {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestUpdater_CNAME(t *testing.T) {
+	var patched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			body, _ := io.ReadAll(r.Body)
+			patched = append(patched, string(body))
+			io.WriteString(w, `{"success":true,"result":{"id":"rec-cname","type":"CNAME","content":"example.com"}}`)
+			return
+		}
+		if typ := r.URL.Query().Get("type"); typ != "CNAME" {
+			t.Errorf("listed %q records", typ)
+		}
+		io.WriteString(w, `{"success":true,"result":[{"id":"rec-cname","type":"CNAME","name":"www.example.com","content":"old.example.net","proxied":true}]}`)
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := Updater{api: api, zone: "zone", domain: "example.com", CNAME: "www.example.com"}
+	publicIP := func(ctx context.Context, network string) (string, error) { return "192.0.2.1", nil }
+	for _, want := range []bool{true, false} {
+		changed, err := up.updateRecordsWith(context.Background(), publicIP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != want {
+			t.Errorf("changed = %v, want %v", changed, want)
+		}
+	}
+	if len(patched) != 1 || !strings.Contains(patched[0], `"content":"example.com"`) || !strings.Contains(patched[0], `"proxied":true`) {
+		t.Errorf("got %q", patched)
+	}
+}
+
+func TestUpdater_Trigger(t *testing.T) {
+	var up Updater
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- up.SyncContext(ctx, time.Hour) }()
+
+	synced := func(after time.Time) time.Time {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if s := up.Status(); s.LastSync.After(after) {
+				return s.LastSync
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("not synced")
+		return time.Time{}
+	}
+
+	first := synced(time.Time{})
+	up.Trigger()
+	synced(first)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdater_RefuseCGNAT(t *testing.T) {
+	tests := map[string]bool{
+		"100.64.1.1":  false,
+		"100.127.0.1": false,
+		"10.0.0.1":    false,
+		"192.0.2.1":   true,
+		"100.128.0.1": true,
+	}
+	for ip, want := range tests {
+		up := Updater{a: "rec-a", DryRun: true, RefuseCGNAT: true}
+		publicIP := func(ctx context.Context, network string) (string, error) { return ip, nil }
+		_, err := up.updateRecordsWith(context.Background(), publicIP)
+		if err != nil && !errors.Is(err, ErrCGNAT) {
+			t.Fatal(err)
+		}
+		if got := err == nil; got != want {
+			t.Errorf("%s: updated = %v, want %v (%v)", ip, got, want, err)
+		}
+		if want != (up.ipv4 == ip) {
+			t.Errorf("%s: got %q", ip, up.ipv4)
+		}
+	}
+}
+
+func TestUpdater_MinWriteInterval(t *testing.T) {
+	up := Updater{a: "rec-a", DryRun: true, MinWriteInterval: time.Hour}
+	ip := "192.0.2.1"
+	publicIP := func(ctx context.Context, network string) (string, error) { return ip, nil }
+
+	// the first write isn't deferred, the next is
+	for _, want := range []string{"192.0.2.1", "192.0.2.1"} {
+		if _, err := up.updateRecordsWith(context.Background(), publicIP); err != nil {
+			t.Fatal(err)
+		}
+		if up.ipv4 != want {
+			t.Errorf("got %q, want %q", up.ipv4, want)
+		}
+		ip = "192.0.2.2"
+	}
+
+	// once the interval passes, the write goes through
+	up.writes["rec-a"] = time.Now().Add(-time.Hour)
+	changed, err := up.updateRecordsWith(context.Background(), publicIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || up.ipv4 != "192.0.2.2" {
+		t.Errorf("got %v, %q", changed, up.ipv4)
+	}
+}
+
+func TestUpdater_Network(t *testing.T) {
+	tests := map[string]string{
+		"":    "ip4 ip6",
+		"ip":  "ip4 ip6",
+		"ip4": "ip4",
+		"ip6": "ip6",
+	}
+	for network, want := range tests {
+		up := Updater{a: "rec-a", aaaa: "rec-aaaa", DryRun: true, Network: network}
+		var fetched []string
+		publicIP := func(ctx context.Context, network string) (string, error) {
+			fetched = append(fetched, network)
+			if network == "ip4" {
+				return "192.0.2.1", nil
+			}
+			return "2001:db8::1", nil
+		}
+		if _, err := up.updateRecordsWith(context.Background(), publicIP); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(fetched, " "); got != want {
+			t.Errorf("%q: fetched %q, want %q", network, got, want)
+		}
+		// the other record is left alone
+		if (up.ipv4 != "") != strings.Contains(want, "ip4") || (up.ipv6 != "") != strings.Contains(want, "ip6") {
+			t.Errorf("%q: got %q, %q", network, up.ipv4, up.ipv6)
+		}
+	}
+}
+
+func TestUpdater_DryRun(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method)
+		io.WriteString(w, `{"success":true,"result":{"id":"rec-a","type":"A","content":"192.0.2.1"}}`)
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := filepath.Join(t.TempDir(), "state.json")
+	up := Updater{api: api, zone: "zone", a: "rec-a", DryRun: true, StateFile: state}
+	publicIP := func(ctx context.Context, network string) (string, error) { return "192.0.2.1", nil }
+	changed, err := up.updateRecordsWith(context.Background(), publicIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || up.ipv4 != "192.0.2.1" {
+		t.Errorf("got %v, %q", changed, up.ipv4)
+	}
+	if len(requests) != 0 {
+		t.Errorf("dry run made requests: %q", requests)
+	}
+	if _, err := os.Stat(state); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("dry run saved state: %v", err)
+	}
+}
+
+func TestUpdater_UpdateChanged(t *testing.T) {
+	up := Updater{a: "rec-a", DryRun: true, ConfirmInterval: time.Hour}
+	local, err := up.localIP(context.Background(), "ip4")
+	if err != nil {
+		t.Skip(err) // no IPv4 route
+	}
+	// the public IP is cached, so it's not fetched
+	up.probes = map[string]probe{"ip4": {local: local, public: "192.0.2.1", checked: time.Now()}}
+
+	for _, want := range []bool{true, false} {
+		changed, ipv4, ipv6, err := up.UpdateChanged()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != want || ipv4 != "192.0.2.1" || ipv6 != "" {
+			t.Errorf("got %v, %q, %q", changed, ipv4, ipv6)
+		}
+	}
+
+	up.Network = "tcp"
+	if _, _, _, err := up.UpdateChanged(); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestUpdater_updateRecord(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case http.MethodGet:
+			if q := r.URL.Query(); q.Get("name") != "example.com" {
+				t.Errorf("listed %v", q)
+			}
+			io.WriteString(w, `{"success":true,"result":[{"id":"rec-a","type":"A","name":"example.com","content":"192.0.2.1","proxied":true}]}`)
+		case http.MethodPatch:
+			body, _ := io.ReadAll(r.Body)
+			if !strings.Contains(string(body), `"content":"192.0.2.2"`) || !strings.Contains(string(body), `"proxied":true`) {
+				t.Errorf("got %s", body)
+			}
+			io.WriteString(w, `{"success":true,"result":{"id":"rec-a","type":"A","content":"192.0.2.2"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL), cloudflare.UsingRateLimit(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := Updater{api: api, zone: "zone", domain: "example.com", lazy: true}
+	publicIP := func(ctx context.Context, network string) (string, error) { return "192.0.2.2", nil }
+	changed, err := up.updateRecordsWith(context.Background(), publicIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || up.ipv4 != "192.0.2.2" {
+		t.Errorf("got %v, %q", changed, up.ipv4)
+	}
+	want := []string{"GET /zones/zone/dns_records", "PATCH /zones/zone/dns_records/rec-a"}
+	if strings.Join(requests, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %q, want %q", requests, want)
+	}
+
+	// a canceled context stops the update
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	requests = nil
+	if err := up.UpdateContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if len(requests) != 0 {
+		t.Errorf("got %q", requests)
+	}
+}
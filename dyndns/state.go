@@ -0,0 +1,82 @@
+package dyndns
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// state is what's persisted to the StateFile.
+type state struct {
+	A    string `json:"a,omitempty"`
+	AAAA string `json:"aaaa,omitempty"`
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+func (up *Updater) state() state {
+	return state{A: up.a, AAAA: up.aaaa, IPv4: up.ipv4, IPv6: up.ipv6}
+}
+
+func (up *Updater) loadState() error {
+	buf, err := os.ReadFile(up.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var st state
+	if err := json.Unmarshal(buf, &st); err != nil {
+		return err
+	}
+	up.saved = st
+
+	// stale state: records were replaced
+	if st.A != up.a || st.AAAA != up.aaaa {
+		return nil
+	}
+	if st.IPv4 != "" {
+		up.ipv4 = st.IPv4
+	}
+	if st.IPv6 != "" {
+		up.ipv6 = st.IPv6
+	}
+	return nil
+}
+
+func (up *Updater) saveState() error {
+	st := up.state()
+	if st == up.saved {
+		return nil
+	}
+
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	// write atomically
+	f, err := os.CreateTemp(filepath.Dir(up.StateFile), filepath.Base(up.StateFile)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), up.StateFile); err != nil {
+		return err
+	}
+
+	up.saved = st
+	return nil
+}
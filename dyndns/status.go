@@ -0,0 +1,63 @@
+package dyndns
+
+import (
+	"strings"
+	"time"
+)
+
+// Status is a snapshot of an Updater's state, e.g. for a debug endpoint.
+type Status struct {
+	A, AAAA    string    // the IDs of the managed A/AAAA records, empty if none
+	IPv4, IPv6 string    // the IPs the A/AAAA records last pointed to
+	LastSync   time.Time // when the last update finished, zero if none has
+	LastError  error     // the error of the last update, nil if it succeeded
+}
+
+// Status returns the current state of the Updater.
+// It's safe to call concurrently with updates.
+func (up *Updater) Status() Status {
+	up.mtx.Lock()
+	defer up.mtx.Unlock()
+	return up.status
+}
+
+// setStatus snapshots the state after an update that failed with err.
+func (up *Updater) setStatus(synced time.Time, err error) {
+	up.mtx.Lock()
+	defer up.mtx.Unlock()
+	up.status = Status{
+		A:         up.a,
+		AAAA:      up.aaaa,
+		IPv4:      up.ipv4,
+		IPv6:      up.ipv6,
+		LastSync:  synced,
+		LastError: err,
+	}
+}
+
+// String formats the status on a single line, e.g. for logging.
+func (s Status) String() string {
+	var buf strings.Builder
+	if s.A != "" {
+		buf.WriteString("A " + s.A + " = " + orNone(s.IPv4) + "; ")
+	}
+	if s.AAAA != "" {
+		buf.WriteString("AAAA " + s.AAAA + " = " + orNone(s.IPv6) + "; ")
+	}
+	if s.LastSync.IsZero() {
+		buf.WriteString("never synced")
+	} else {
+		buf.WriteString("last synced " + s.LastSync.Format(time.RFC3339))
+	}
+	if s.LastError != nil {
+		buf.WriteString("; last error: " + s.LastError.Error())
+	}
+	return buf.String()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
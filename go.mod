@@ -8,6 +8,7 @@ require (
 	github.com/cloudflare/cloudflare-go v0.112.0
 	github.com/mholt/acmez v1.2.0
 	github.com/ncruces/go-dns v1.2.5
+	golang.org/x/sys v0.28.0
 )
 
 require (
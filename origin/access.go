@@ -0,0 +1,252 @@
+package origin
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VerifyTunnelJWT returns middleware that only accepts requests
+// authenticated by Cloudflare Access (e.g. through Cloudflare Tunnel).
+//
+// Each request must carry a Cf-Access-Jwt-Assertion header with a JWT
+// signed by the team's keys (fetched from https://<teamDomain>/cdn-cgi/access/certs),
+// issued for the application's audience (AUD) tag, and not expired.
+// Other requests are rejected with 401 Unauthorized.
+//
+// Usage:
+//
+//	verify := origin.VerifyTunnelJWT("example.cloudflareaccess.com", "[Application Audience (AUD) Tag]")
+//	log.Fatal(http.Serve(ln, verify(http.DefaultServeMux)))
+func VerifyTunnelJWT(teamDomain, audience string) func(http.Handler) http.Handler {
+	teamDomain = strings.TrimSuffix(strings.TrimPrefix(teamDomain, "https://"), "/")
+	keys := accessKeys{url: "https://" + teamDomain + "/cdn-cgi/access/certs"}
+	issuer := "https://" + teamDomain
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("Cf-Access-Jwt-Assertion")
+			if err := keys.verify(r.Context(), token, issuer, audience); err != nil {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ErrInvalidToken is returned for Cloudflare Access tokens that fail verification.
+const ErrInvalidToken stringError = "invalid Cloudflare Access token"
+
+type accessKeys struct {
+	url     string
+	mutex   sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	refresh time.Time
+	fetch   *accessFetch
+}
+
+// accessFetch is a pending fetch of the keys, shared by concurrent callers.
+type accessFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func (a *accessKeys) verify(ctx context.Context, token, issuer, audience string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return ErrInvalidToken
+	}
+
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+		return ErrInvalidToken
+	}
+
+	var claims struct {
+		Iss string      `json:"iss"`
+		Aud jwtAudience `json:"aud"`
+		Exp int64       `json:"exp"`
+		Nbf int64       `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return err
+	}
+
+	const leeway = time.Minute
+	now := time.Now()
+	switch {
+	case claims.Iss != issuer:
+		return ErrInvalidToken
+	case !claims.Aud.contains(audience):
+		return ErrInvalidToken
+	case now.After(time.Unix(claims.Exp, 0).Add(leeway)):
+		return ErrInvalidToken
+	case now.Before(time.Unix(claims.Nbf, 0).Add(-leeway)):
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (a *accessKeys) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	a.mutex.Lock()
+	key := a.keys[kid]
+	// keys rotate: fetch them at most once a minute
+	if key == nil && time.Since(a.refresh) > time.Minute {
+		f := a.fetch
+		if f == nil {
+			f = &accessFetch{done: make(chan struct{})}
+			a.fetch = f
+			go a.load(f)
+		}
+		a.mutex.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if f.err != nil {
+			return nil, f.err
+		}
+
+		a.mutex.Lock()
+		key = a.keys[kid]
+	}
+	a.mutex.Unlock()
+
+	if key == nil {
+		return nil, ErrInvalidToken
+	}
+	return key, nil
+}
+
+// load fetches the keys, for all callers waiting on f.
+// It doesn't use their contexts, so one canceled request doesn't fail the others.
+func (a *accessKeys) load(f *accessFetch) {
+	keys, err := loadAccessKeys(context.Background(), a.url)
+
+	a.mutex.Lock()
+	if err == nil {
+		a.keys = keys
+		a.refresh = time.Now()
+	}
+	a.fetch = nil
+	a.mutex.Unlock()
+
+	f.err = err
+	close(f.done)
+}
+
+func loadAccessKeys(ctx context.Context, url string) (map[string]*rsa.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	buf, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// jwtAudience is the JWT aud claim: a string, or an array of strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = jwtAudience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a jwtAudience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package origin
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVerifyTunnelJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first fetch fails
+		if fetches++; fetches == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": []any{map[string]string{
+			"kid": "test", "kty": "RSA", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer srv.Close()
+
+	sign := func(claims map[string]any) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+		payload, _ := json.Marshal(claims)
+		data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		hash := sha256.Sum256([]byte(data))
+		sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	keys := accessKeys{url: srv.URL}
+	ctx := context.Background()
+	iss := "https://example.cloudflareaccess.com"
+	exp := time.Now().Add(time.Hour).Unix()
+
+	// a failed fetch is retried right away
+	if err := keys.verify(ctx, sign(map[string]any{"iss": iss, "aud": "aud", "exp": exp}), iss, "aud"); err == nil {
+		t.Error("accepted token without keys")
+	}
+	if err := keys.verify(ctx, sign(map[string]any{"iss": iss, "aud": []string{"aud"}, "exp": exp}), iss, "aud"); err != nil {
+		t.Error(err)
+	}
+	if err := keys.verify(ctx, sign(map[string]any{"iss": iss, "aud": "aud", "exp": exp}), iss, "aud"); err != nil {
+		t.Error(err)
+	}
+	if err := keys.verify(ctx, sign(map[string]any{"iss": iss, "aud": "other", "exp": exp}), iss, "aud"); err == nil {
+		t.Error("accepted wrong audience")
+	}
+	if err := keys.verify(ctx, sign(map[string]any{"iss": iss, "aud": "aud", "exp": 1}), iss, "aud"); err == nil {
+		t.Error("accepted expired token")
+	}
+	if err := keys.verify(ctx, sign(map[string]any{"iss": iss, "aud": "aud", "exp": exp})+"x", iss, "aud"); err == nil {
+		t.Error("accepted bad signature")
+	}
+	if err := keys.verify(ctx, "", iss, "aud"); err == nil {
+		t.Error("accepted empty token")
+	}
+	if fetches != 2 {
+		t.Errorf("keys fetched %d times", fetches)
+	}
+}
@@ -0,0 +1,139 @@
+package origin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AccessLog returns middleware that writes a JSON line to w for each request.
+//
+// Each line includes the peer address, and if the peer is a Cloudflare IP,
+// the client IP from CF-Connecting-IP and the CF-Ray ID.
+// These headers are omitted for other peers, as they could be spoofed.
+//
+// Usage:
+//
+//	logger := origin.AccessLog(os.Stderr)
+//	server.Handler = logger(http.DefaultServeMux)
+//	log.Fatal(server.ServeTLS(ln, "", ""))
+func AccessLog(w io.Writer) func(http.Handler) http.Handler {
+	return defaultFilter.AccessLog(w)
+}
+
+// AccessLog returns middleware that writes a JSON line to w for each request,
+// trusting the CF-Connecting-IP and CF-Ray headers from peers in the filter's IP ranges.
+func (f *Filter) AccessLog(w io.Writer) func(http.Handler) http.Handler {
+	var mutex sync.Mutex
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			lw := &logWriter{ResponseWriter: rw}
+			next.ServeHTTP(lw, r)
+
+			entry := accessLogEntry{
+				Time:     start,
+				Peer:     r.RemoteAddr,
+				Method:   r.Method,
+				Host:     r.Host,
+				URI:      r.RequestURI,
+				Status:   lw.status,
+				Bytes:    lw.bytes,
+				Duration: time.Since(start).Seconds(),
+			}
+			if entry.Status == 0 {
+				entry.Status = http.StatusOK
+			}
+			if f.trustedPeer(r) {
+				entry.ClientIP = r.Header.Get("CF-Connecting-IP")
+				entry.Ray = r.Header.Get("CF-Ray")
+			}
+
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return
+			}
+			line = append(line, '\n')
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			w.Write(line)
+		})
+	}
+}
+
+type accessLogEntry struct {
+	Time     time.Time `json:"time"`
+	Peer     string    `json:"peer"`
+	ClientIP string    `json:"cf_connecting_ip,omitempty"`
+	Ray      string    `json:"cf_ray,omitempty"`
+	Method   string    `json:"method"`
+	Host     string    `json:"host"`
+	URI      string    `json:"uri"`
+	Status   int       `json:"status"`
+	Bytes    int64     `json:"bytes"`
+	Duration float64   `json:"duration"` // seconds
+}
+
+func (f *Filter) trustedPeer(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return f.checkIP(&net.IPAddr{IP: ip})
+}
+
+type logWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *logWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (w *logWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush allows handlers that type assert http.Flusher (e.g. for Server-Sent Events)
+// to flush buffered data to the client.
+func (w *logWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack allows handlers that type assert http.Hijacker (e.g. for WebSockets)
+// to take over the connection; hijacked requests are logged as status 101.
+func (w *logWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, buf, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return c, buf, err
+}
@@ -0,0 +1,97 @@
+package origin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var f Filter
+	_, n, _ := net.ParseCIDR("192.0.2.0/24")
+	f.SetIPRanges(*n)
+
+	var buf bytes.Buffer
+	handler := f.AccessLog(&buf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and stout")
+	}))
+
+	for _, peer := range []string{"192.0.2.1:1234", "198.51.100.1:1234"} {
+		r := httptest.NewRequest("GET", "/tea", nil)
+		r.RemoteAddr = peer
+		r.Header.Set("CF-Connecting-IP", "203.0.113.1")
+		r.Header.Set("CF-Ray", "1234-LIS")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	dec := json.NewDecoder(&buf)
+	for _, trusted := range []bool{true, false} {
+		var entry accessLogEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Status != http.StatusTeapot || entry.Bytes != 15 || entry.URI != "/tea" {
+			t.Errorf("got %+v", entry)
+		}
+		if (entry.ClientIP == "203.0.113.1" && entry.Ray == "1234-LIS") != trusted {
+			t.Errorf("trusted = %v, got %+v", trusted, entry)
+		}
+	}
+}
+
+func TestAccessLog_flushHijack(t *testing.T) {
+	// log lines are written after the response, so read them from a pipe
+	pr, pw := io.Pipe()
+	srv := httptest.NewServer(AccessLog(pw)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			io.WriteString(w, "data: ok\n\n")
+			w.(http.Flusher).Flush()
+			return
+		}
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Error("not a Hijacker")
+			return
+		}
+		c, buf, err := hj.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+	})))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	dec := json.NewDecoder(pr)
+	for _, want := range []int{http.StatusOK, http.StatusSwitchingProtocols} {
+		var entry accessLogEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Status != want {
+			t.Errorf("got %+v, want status %d", entry, want)
+		}
+	}
+}
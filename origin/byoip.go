@@ -0,0 +1,32 @@
+package origin
+
+import (
+	"context"
+	"net"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// FetchBYOIPRanges fetches the Bring Your Own IP (BYOIP) prefixes of a Cloudflare account,
+// given an API instance with a token with Account.IP Prefixes read permission.
+//
+// Usage:
+//
+//	var filter origin.Filter
+//	filter.ExtraRanges, err = origin.FetchBYOIPRanges(ctx, api, "[Account ID]")
+func FetchBYOIPRanges(ctx context.Context, api *cloudflare.API, accountID string) ([]net.IPNet, error) {
+	prefixes, err := api.ListPrefixes(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	var nets []net.IPNet
+	for _, p := range prefixes {
+		_, n, err := net.ParseCIDR(p.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, *n)
+	}
+	return nets, nil
+}
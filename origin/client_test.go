@@ -0,0 +1,54 @@
+package origin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewClientTransport(t *testing.T) {
+	pool := func(cert tls.Certificate) *x509.CertPool {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(leaf)
+		return pool
+	}
+	serverCert, clientCert := testCertificate(t), testCertificate(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, clientCert, certFile, keyFile)
+
+	// the server authenticates the client
+	server := NewServerWithCerts(pool(clientCert), serverCert)
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	transport, err := NewClientTransport(certFile, keyFile, pool(serverCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.TLSClientConfig.ServerName = "example.com"
+	defer transport.CloseIdleConnections()
+
+	client := http.Client{Transport: transport}
+	res, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.TLS == nil || len(res.TLS.VerifiedChains) == 0 {
+		t.Error("server not verified")
+	}
+}
@@ -0,0 +1,103 @@
+package origin
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// DebugRejections completes handshakes that would otherwise be rejected,
+// serving cert, and responds to their requests with an error that explains why:
+// 403 Forbidden for peers that aren't Cloudflare IPs,
+// 421 Misdirected Request for a missing or mismatched SNI.
+//
+// This is a debugging aid, and weakens the server: don't use it in production.
+// To diagnose non-Cloudflare peers, serve an unfiltered listener (e.g. from net.Listen),
+// as the listeners from this package drop their connections before the handshake.
+// Client certificates aren't required for rejected handshakes.
+func DebugRejections(cert tls.Certificate) ServerOption {
+	return &debugRejections{cert: cert, filter: &defaultFilter}
+}
+
+type debugRejections struct {
+	cert    tls.Certificate
+	filter  *Filter
+	reasons sync.Map // net.Conn → *rejection
+}
+
+type rejection struct {
+	status int
+	reason string
+}
+
+type rawConnKey struct{}
+
+func (o *debugRejections) apply(s *http.Server) {
+	base := s.TLSConfig
+	getConfigForClient := base.GetConfigForClient
+	base.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		if rej := o.reject(base, info); rej != nil {
+			o.reasons.Store(info.Conn, rej)
+
+			config := base.Clone()
+			config.GetConfigForClient = nil
+			config.ClientAuth = tls.NoClientCert
+			config.ClientCAs = nil
+			config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return &o.cert, nil
+			}
+			return config, nil
+		}
+		if getConfigForClient != nil {
+			return getConfigForClient(info)
+		}
+		return nil, nil
+	}
+
+	// remember the underlying connection, which GetConfigForClient sees
+	connContext := s.ConnContext
+	s.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		if tc, ok := c.(*tls.Conn); ok {
+			ctx = context.WithValue(ctx, rawConnKey{}, tc.NetConn())
+		}
+		return ctx
+	}
+
+	connState := s.ConnState
+	s.ConnState = func(c net.Conn, state http.ConnState) {
+		if connState != nil {
+			connState(c, state)
+		}
+		if tc, ok := c.(*tls.Conn); ok && (state == http.StateClosed || state == http.StateHijacked) {
+			o.reasons.Delete(tc.NetConn())
+		}
+	}
+
+	handler := s.Handler
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c := r.Context().Value(rawConnKey{}); c != nil {
+			if rej, ok := o.reasons.Load(c); ok {
+				rej := rej.(*rejection)
+				http.Error(w, rej.reason, rej.status)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (o *debugRejections) reject(config *tls.Config, info *tls.ClientHelloInfo) *rejection {
+	// only TCP peers have IPs to check
+	if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok && !o.filter.checkIP(addr) {
+		return &rejection{http.StatusForbidden, ErrNotCloudflare.Error()}
+	}
+	if _, err := config.GetCertificate(info); err != nil {
+		return &rejection{http.StatusMisdirectedRequest, err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package origin
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestDebugRejections(t *testing.T) {
+	cert := testCertificate(t)
+	option := DebugRejections(cert).(*debugRejections)
+	option.filter = &Filter{}
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	option.filter.SetIPRanges(*n)
+
+	server := NewServerWithCerts(nil, cert)
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	option.apply(server)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	for name, want := range map[string]int{
+		"example.com": http.StatusOK,
+		"example.net": http.StatusMisdirectedRequest,
+	} {
+		client := http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: name, InsecureSkipVerify: true},
+		}}
+		res, err := client.Get("https://" + ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("%s: got %d, want %d", name, res.StatusCode, want)
+		}
+	}
+
+	// not a Cloudflare IP
+	_, n, _ = net.ParseCIDR("192.0.2.0/24")
+	option.filter.SetIPRanges(*n)
+	client := http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "example.com", InsecureSkipVerify: true},
+	}}
+	res, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("got %d, want %d", res.StatusCode, http.StatusForbidden)
+	}
+}
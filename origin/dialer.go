@@ -0,0 +1,55 @@
+package origin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// DialContext connects to the address on the named network,
+// but only if the address resolves to a Cloudflare IP.
+//
+// The check is made against the address actually being dialed,
+// so it can't be bypassed by DNS rebinding.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return defaultFilter.DialContext(ctx, network, address)
+}
+
+// NewTransport returns an http.Transport that only connects to Cloudflare IPs.
+//
+// Proxies are not used, as they're unlikely to be Cloudflare IPs.
+func NewTransport() *http.Transport {
+	return defaultFilter.NewTransport()
+}
+
+// DialContext connects to the address on the named network,
+// but only if the address resolves to one of the filter's IP ranges.
+func (f *Filter) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   f.controlDial,
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// NewTransport returns an http.Transport that only connects to the filter's IP ranges.
+func (f *Filter) NewTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = f.DialContext
+	return t
+}
+
+func (f *Filter) controlDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !f.checkIP(&net.IPAddr{IP: net.ParseIP(host)}) {
+		return ErrNotCloudflare
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package origin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilter_DialContext(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, docs, _ := net.ParseCIDR("192.0.2.0/24")
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var allowed, rejected Filter
+	allowed.SetIPRanges(*loopback)
+	rejected.SetIPRanges(*docs)
+
+	tests := []struct {
+		filter  *Filter
+		address string
+		want    error
+	}{
+		{&allowed, ln.Addr().String(), nil},
+		{&rejected, ln.Addr().String(), ErrNotCloudflare},
+		{&rejected, net.JoinHostPort("localhost", port), ErrNotCloudflare},
+	}
+	for _, tt := range tests {
+		c, err := tt.filter.DialContext(context.Background(), "tcp4", tt.address)
+		if err == nil {
+			c.Close()
+		}
+		if !errors.Is(err, tt.want) || (err == nil) != (tt.want == nil) {
+			t.Errorf("DialContext(%s) = %v, want %v", tt.address, err, tt.want)
+		}
+	}
+}
+
+func TestFilter_NewTransport(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, docs, _ := net.ParseCIDR("192.0.2.0/24")
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	var f Filter
+	f.SetIPRanges(*loopback)
+	client := http.Client{Transport: f.NewTransport()}
+	res, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	client.CloseIdleConnections()
+
+	f.SetIPRanges(*docs)
+	if _, err := client.Get(srv.URL); !errors.Is(err, ErrNotCloudflare) {
+		t.Errorf("got %v, want %v", err, ErrNotCloudflare)
+	}
+}
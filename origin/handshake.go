@@ -0,0 +1,115 @@
+package origin
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// NewHandshakeListener returns a listener that completes the TLS handshake
+// of connections accepted from ln, before returning them from Accept.
+//
+// Connections that don't complete the handshake within timeout are dropped,
+// so clients can't hold connections open mid-handshake.
+// Handshakes happen concurrently, so slow clients don't block Accept.
+//
+// Errors from ln.Accept are returned by Accept, which keeps working until ln is closed;
+// http.Server.Serve retries those that are temporary.
+//
+// Returned connections are *tls.Conn, so serve them with http.Server.Serve, not ServeTLS.
+// Like ServeTLS, if config.NextProtos is empty, it's set to offer HTTP/2 and HTTP/1.1,
+// which makes Serve configure HTTP/2; the NextProtos option overrides this.
+//
+//	server := origin.NewServerWithCerts(pullCA, certs...)
+//	ln, err := origin.Listen("tcp", ":https")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(server.Serve(origin.NewHandshakeListener(ln, server.TLSConfig, 5*time.Second)))
+func NewHandshakeListener(ln net.Listener, config *tls.Config, timeout time.Duration) net.Listener {
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return &handshakeListener{
+		Listener: ln,
+		config:   config,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+type handshakeListener struct {
+	net.Listener
+	config  *tls.Config
+	timeout time.Duration
+
+	start sync.Once
+	close sync.Once
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	err   error
+}
+
+func (ln *handshakeListener) Accept() (net.Conn, error) {
+	// start lazily: http.Server configures TLS before accepting
+	ln.start.Do(func() { go ln.acceptLoop() })
+
+	select {
+	case c := <-ln.conns:
+		return c, nil
+	case err := <-ln.errs:
+		return nil, err
+	case <-ln.done:
+		return nil, ln.err
+	}
+}
+
+func (ln *handshakeListener) Close() error {
+	ln.close.Do(func() { ln.err = net.ErrClosed; close(ln.done) })
+	return ln.Listener.Close()
+}
+
+func (ln *handshakeListener) acceptLoop() {
+	for {
+		c, err := ln.Listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			ln.close.Do(func() { ln.err = err; close(ln.done) })
+			return
+		}
+		if err != nil {
+			// let the caller decide whether to retry
+			select {
+			case ln.errs <- err:
+				continue
+			case <-ln.done:
+				return
+			}
+		}
+		go ln.handshake(c)
+	}
+}
+
+func (ln *handshakeListener) handshake(c net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), ln.timeout)
+	defer cancel()
+
+	tc := tls.Server(c, ln.config)
+	c.SetDeadline(time.Now().Add(ln.timeout))
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	select {
+	case ln.conns <- tc:
+	case <-ln.done:
+		c.Close()
+	}
+}
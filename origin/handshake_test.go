@@ -0,0 +1,116 @@
+package origin
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewHandshakeListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	ln := NewHandshakeListener(inner, config, 100*time.Millisecond)
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, "hello")
+			c.Close()
+		}
+	}()
+
+	// a stalled handshake is dropped
+	stalled, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	stalled.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+
+	// a completed handshake is accepted
+	c, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if buf, err := io.ReadAll(c); string(buf) != "hello" {
+		t.Errorf("got %q, %v", buf, err)
+	}
+}
+
+func TestNewHandshakeListener_http2(t *testing.T) {
+	cert := testCertificate(t)
+
+	for want, options := range map[int][]ServerOption{
+		2: nil,
+		1: {NextProtos("http/1.1")},
+	} {
+		server := NewServerWithOptions(nil, []tls.Certificate{cert}, options...)
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(NewHandshakeListener(inner, server.TLSConfig, time.Second))
+
+		client := http.Client{Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig: &tls.Config{
+				ServerName:         "example.com",
+				InsecureSkipVerify: true,
+			},
+		}}
+		res, err := client.Get("https://" + inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.ProtoMajor != want {
+			t.Errorf("got %s, want HTTP/%d", res.Proto, want)
+		}
+		client.CloseIdleConnections()
+		server.Close()
+	}
+}
+
+func TestNewHandshakeListener_errors(t *testing.T) {
+	inner := &flakyListener{errs: []error{errors.New("temporary")}}
+	ln := NewHandshakeListener(inner, &tls.Config{}, time.Second)
+
+	// errors are passed on, and the listener keeps going
+	if _, err := ln.Accept(); err == nil || errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v", err)
+	}
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// flakyListener fails Accept with errs, then with net.ErrClosed.
+type flakyListener struct {
+	net.Listener
+	errs []error
+}
+
+func (ln *flakyListener) Accept() (net.Conn, error) {
+	if len(ln.errs) > 0 {
+		err := ln.errs[0]
+		ln.errs = ln.errs[1:]
+		return nil, err
+	}
+	return nil, net.ErrClosed
+}
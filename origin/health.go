@@ -0,0 +1,31 @@
+package origin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// HealthHandler reports whether the Cloudflare IP ranges have been loaded.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	defaultFilter.HealthHandler(w, r)
+}
+
+// HealthHandler reports whether the filter's Cloudflare IP ranges have been loaded.
+//
+// It responds with 503 Service Unavailable if the ranges were never loaded,
+// and with 200 OK and a JSON body stating when they were last refreshed, otherwise.
+func (f *Filter) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	last, _ := f.updated.Load().(time.Time)
+	ips, _ := f.ips.Load().(*ipRanges)
+	if last.IsZero() || ips == nil {
+		http.Error(w, "Cloudflare IP ranges not loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		LastRefresh time.Time `json:"last_refresh"`
+		RangeCount  int       `json:"range_count"`
+	}{last, ips.count})
+}
@@ -0,0 +1,32 @@
+package origin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFilter_HealthHandler(t *testing.T) {
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+
+	tests := []struct {
+		name   string
+		filter func(f *Filter)
+		want   int
+	}{
+		{"empty", func(f *Filter) {}, http.StatusServiceUnavailable},
+		{"no ranges", func(f *Filter) { f.updated.Store(time.Now()) }, http.StatusServiceUnavailable},
+		{"loaded", func(f *Filter) { f.SetIPRanges(*n) }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		var f Filter
+		tt.filter(&f)
+		w := httptest.NewRecorder()
+		f.HealthHandler(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package origin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// ETag returns the etag of the IP ranges last fetched from the JSON API,
+// or an empty string if the API isn't used.
+func (f *Filter) ETag() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.etag
+}
+
+// fetchAPI fetches the IP ranges from the JSON API.
+// It returns nil ranges if the etag is unchanged.
+// Called with the mutex held.
+func (f *Filter) fetchAPI(ctx context.Context) ([]net.IPNet, error) {
+	url := f.APIURL
+	if url == "" {
+		url = defaultAPIURL
+	}
+	if f.IncludeChina {
+		if strings.Contains(url, "?") {
+			url += "&networks=jdcloud"
+		} else {
+			url += "?networks=jdcloud"
+		}
+	}
+
+	var res *apiIPs
+	var err error
+	if f.API != nil {
+		res, err = loadAuthAPI(ctx, f.API, f.IncludeChina)
+	} else {
+		res, err = loadAPI(ctx, url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.ETag != "" && res.ETag == f.etag {
+		return nil, nil
+	}
+
+	var nets []net.IPNet
+	cidrs := append(res.IPv4CIDRs, res.IPv6CIDRs...)
+	if f.IncludeChina {
+		cidrs = append(cidrs, res.JDCloudCIDRs...)
+	}
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, *n)
+	}
+	if len(nets) == 0 {
+		return nil, ErrNoRanges
+	}
+
+	f.etag = res.ETag
+	return nets, nil
+}
+
+type apiIPs struct {
+	IPv4CIDRs    []string `json:"ipv4_cidrs"`
+	IPv6CIDRs    []string `json:"ipv6_cidrs"`
+	JDCloudCIDRs []string `json:"jdcloud_cidrs"`
+	ETag         string   `json:"etag"`
+}
+
+func loadAuthAPI(ctx context.Context, api *cloudflare.API, china bool) (*apiIPs, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	endpoint := "/ips"
+	if china {
+		endpoint += "?networks=jdcloud"
+	}
+	res, err := api.Raw(ctx, http.MethodGet, endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips apiIPs
+	if err := json.Unmarshal(res.Result, &ips); err != nil {
+		return nil, err
+	}
+	return &ips, nil
+}
+
+func loadAPI(ctx context.Context, url string) (*apiIPs, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+
+	var body struct {
+		Result  apiIPs `json:"result"`
+		Success bool   `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if !body.Success {
+		if len(body.Errors) > 0 {
+			return nil, errors.New(body.Errors[0].Message)
+		}
+		return nil, errors.New("request failed")
+	}
+	return &body.Result, nil
+}
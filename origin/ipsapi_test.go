@@ -0,0 +1,60 @@
+package origin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+func TestFilter_fetchAPI(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		res := map[string]any{
+			"success": true,
+			"result": map[string]any{
+				"ipv4_cidrs": []string{"192.0.2.0/24"},
+				"ipv6_cidrs": []string{"2001:db8::/32"},
+				"etag":       "abc",
+			},
+		}
+		if r.URL.Query().Get("networks") == "jdcloud" {
+			res["result"].(map[string]any)["jdcloud_cidrs"] = []string{"198.51.100.0/24"}
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+
+	f := Filter{UseJSONAPI: true, APIURL: srv.URL, IncludeChina: true}
+	nets, err := f.fetchIPs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 || f.ETag() != "abc" {
+		t.Errorf("got %v, %q", nets, f.ETag())
+	}
+
+	// unchanged
+	nets, err = f.fetchIPs(context.Background())
+	if err != nil || nets != nil {
+		t.Errorf("got %v, %v", nets, err)
+	}
+
+	// through cloudflare-go
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = Filter{API: api, IncludeChina: true}
+	nets, err = f.fetchIPs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 || f.ETag() != "abc" || auth != "Bearer token" {
+		t.Errorf("got %v, %q, %q", nets, f.ETag(), auth)
+	}
+}
@@ -4,73 +4,263 @@ import (
 	"bufio"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/cloudflare/cloudflare-go"
 )
 
-const errNotCloudflare stringError = "not a Cloudflare IP"
+// ErrNotCloudflare is returned for connections from, or to, peers that aren't Cloudflare IPs.
+const ErrNotCloudflare stringError = "not a Cloudflare IP"
+
+var client atomic.Pointer[http.Client]
+
+// SetHTTPClient sets the http.Client used to fetch Cloudflare's IP ranges and origin pull CA,
+// e.g. to use a proxy or a private trust store.
+// A nil client restores http.DefaultClient.
+func SetHTTPClient(c *http.Client) {
+	client.Store(c)
+}
+
+func httpClient() *http.Client {
+	if c := client.Load(); c != nil {
+		return c
+	}
+	return http.DefaultClient
+}
+
+// A Filter accepts connections from Cloudflare IP ranges,
+// keeping its own copy of the ranges, which it refreshes hourly.
+// Until the ranges are first fetched, all connections are rejected,
+// and the fetch is retried every minute (use ListenWarm to fail fast instead).
+//
+// Package level functions use a shared default Filter.
+// Other filters allow independent refresh policies, and isolated tests.
+//
+// The zero value is ready to use.
+// A Filter must not be copied after first use.
+type Filter struct {
+	// IPv4URL and IPv6URL are where the IP ranges are fetched from,
+	// one CIDR per line.
+	// If empty, Cloudflare's published lists are used.
+	IPv4URL, IPv6URL string
+
+	// UseJSONAPI fetches the IP ranges from Cloudflare's JSON API (at APIURL),
+	// instead of the plain text lists.
+	// The API's etag is used to skip rebuilding the ranges when they're unchanged.
+	UseJSONAPI bool
+
+	// APIURL is where the JSON API is fetched from.
+	// If empty, https://api.cloudflare.com/client/v4/ips is used.
+	APIURL string
+
+	// API, if set, fetches the JSON API through a cloudflare-go client (implies UseJSONAPI),
+	// authenticated with its token, and ignoring APIURL.
+	// This reuses the API's connectivity, where www.cloudflare.com is unreachable.
+	API *cloudflare.API
+
+	// IncludeChina also accepts the China network (JD Cloud) ranges.
+	// Requires UseJSONAPI (or API).
+	IncludeChina bool
+
+	// ExtraRanges are accepted in addition to the fetched ranges,
+	// e.g. an account's Bring Your Own IP (BYOIP) prefixes (see FetchBYOIPRanges).
+	// To replace the fetched ranges instead, use SetIPRanges.
+	ExtraRanges []net.IPNet
+
+	// OnReject, if set, is called with the address of each rejected peer,
+	// e.g. to count or log direct-to-origin scanning.
+	// It's called synchronously from Accept (or the handshake), so it shouldn't block.
+	OnReject func(addr net.Addr)
+
+	// MaxConns, if positive, limits the open connections of each listener;
+	// once reached, Accept waits for connections to close.
+	// This provides simple backpressure, independent of the server's limits.
+	MaxConns int
 
-var (
 	ips     atomic.Value
+	updated atomic.Value
 	mutex   sync.Mutex
 	refresh time.Time
+	next    atomic.Int64 // when a refresh is next due, in Unix nanoseconds
+	static  bool
+	etag    string
+	ipv4    *ipList
+	ipv6    *ipList
+}
+
+const (
+	defaultIPv4URL = "https://www.cloudflare.com/ips-v4"
+	defaultIPv6URL = "https://www.cloudflare.com/ips-v6"
+	defaultAPIURL  = "https://api.cloudflare.com/client/v4/ips"
 )
 
+var defaultFilter Filter
+
 // Listen only accepts TCP connections from Cloudflare IP ranges.
+//
+// The "unix" network is also accepted, for use behind Cloudflare Tunnel (cloudflared).
+// Unix domain sockets have no peer IP to check, so connections aren't filtered;
+// the server's SNI, Host and mTLS checks still apply.
 func Listen(network, address string) (net.Listener, error) {
+	return defaultFilter.Listen(network, address)
+}
+
+// ListenWarm is like Listen, but fetches the IP ranges before returning,
+// so Cloudflare connections are accepted as soon as the listener starts.
+// It returns an error if the fetch fails.
+func ListenWarm(network, address string) (net.Listener, error) {
+	return defaultFilter.ListenWarm(network, address)
+}
+
+// ListenWithConfig is like Listen, but uses lc to create the listener.
+//
+// This allows setting socket options, e.g. using ReusePort.
+func ListenWithConfig(ctx context.Context, lc *net.ListenConfig, network, address string) (net.Listener, error) {
+	return defaultFilter.ListenWithConfig(ctx, lc, network, address)
+}
+
+// NewListener returns a listener that only accepts TCP connections from Cloudflare IP ranges.
+//
+// The IP ranges are refreshed hourly in the background, until the listener is closed.
+func NewListener(ln net.Listener) net.Listener {
+	return defaultFilter.NewListener(ln)
+}
+
+// Listen only accepts TCP connections from Cloudflare IP ranges.
+func (f *Filter) Listen(network, address string) (net.Listener, error) {
+	return f.ListenWithConfig(context.Background(), &net.ListenConfig{}, network, address)
+}
+
+// ListenWarm is like Listen, but fetches the IP ranges before returning.
+func (f *Filter) ListenWarm(network, address string) (net.Listener, error) {
+	if err := f.warmIPs(); err != nil {
+		return nil, err
+	}
+	return f.Listen(network, address)
+}
+
+// ListenWithConfig is like Listen, but uses lc to create the listener.
+func (f *Filter) ListenWithConfig(ctx context.Context, lc *net.ListenConfig, network, address string) (net.Listener, error) {
+	if network == "unix" {
+		// no peer IP to filter
+		return lc.Listen(ctx, network, address)
+	}
 	if !strings.HasPrefix(network, "tcp") {
 		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: nil, Err: &net.AddrError{Err: "unexpected address type", Addr: address}}
 	}
 
-	ln, err := net.Listen(network, address)
+	ln, err := lc.Listen(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
-	go updateIPs()
-	return listener{ln}, nil
+	return f.NewListener(ln), nil
 }
 
 // NewListener returns a listener that only accepts TCP connections from Cloudflare IP ranges.
-func NewListener(ln net.Listener) net.Listener {
-	return listener{ln}
+//
+// The IP ranges are refreshed hourly in the background, until the listener is closed.
+func (f *Filter) NewListener(ln net.Listener) net.Listener {
+	l := &listener{Listener: ln, filter: f, done: make(chan struct{})}
+	if f.MaxConns > 0 {
+		l.sem = make(chan struct{}, f.MaxConns)
+	}
+	go f.refreshIPs(l.done)
+	return l
 }
 
-var _ net.Listener = listener{}
+var _ net.Listener = &listener{}
 var _ net.Conn = conn{}
 
 type listener struct {
 	net.Listener
+	filter *Filter
+	done   chan struct{}
+	once   sync.Once
+	sem    chan struct{} // limits open connections, if not nil
+}
+
+// Close closes the listener, and stops refreshing IP ranges.
+func (ln *listener) Close() error {
+	ln.once.Do(func() { close(ln.done) })
+	return ln.Listener.Close()
 }
 
-func (ln listener) Accept() (net.Conn, error) {
+func (ln *listener) Accept() (net.Conn, error) {
+	if ln.sem != nil {
+		select {
+		case ln.sem <- struct{}{}:
+		case <-ln.done:
+			return nil, net.ErrClosed
+		}
+	}
+
 	c, err := ln.Listener.Accept()
 	if err != nil {
+		ln.release()
 		return nil, err
 	}
-	if !checkIP(c.RemoteAddr()) {
+	if !ln.filter.checkIP(c.RemoteAddr()) {
+		ln.release()
+		metrics.rejectedIP.Add(1)
+		ln.filter.reject(c.RemoteAddr())
 		c.Close()
 		return conn{c}, nil
 	}
+	if ln.sem != nil {
+		return &limitedConn{Conn: c, release: ln.release}, nil
+	}
 	return c, nil
 }
 
+func (ln *listener) release() {
+	if ln.sem != nil {
+		<-ln.sem
+	}
+}
+
+// limitedConn releases its listener slot when first closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
 type conn struct {
 	net.Conn
 }
 
-func (c conn) Read(b []byte) (n int, err error)   { return 0, errNotCloudflare }
-func (c conn) Write(b []byte) (n int, err error)  { return 0, errNotCloudflare }
-func (c conn) SetDeadline(t time.Time) error      { return errNotCloudflare }
-func (c conn) SetReadDeadline(t time.Time) error  { return errNotCloudflare }
-func (c conn) SetWriteDeadline(t time.Time) error { return errNotCloudflare }
+func (c conn) Read(b []byte) (n int, err error)   { return 0, ErrNotCloudflare }
+func (c conn) Write(b []byte) (n int, err error)  { return 0, ErrNotCloudflare }
+func (c conn) SetDeadline(t time.Time) error      { return ErrNotCloudflare }
+func (c conn) SetReadDeadline(t time.Time) error  { return ErrNotCloudflare }
+func (c conn) SetWriteDeadline(t time.Time) error { return ErrNotCloudflare }
 func (c conn) Close() error                       { return nil }
 
+func (f *Filter) reject(addr net.Addr) {
+	if f.OnReject != nil {
+		f.OnReject(addr)
+	}
+}
+
 func checkIP(addr net.Addr) bool {
+	return defaultFilter.checkIP(addr)
+}
+
+func (f *Filter) checkIP(addr net.Addr) bool {
 	var ip net.IP
 	switch addr := addr.(type) {
 	case *net.TCPAddr:
@@ -81,89 +271,264 @@ func checkIP(addr net.Addr) bool {
 		ip = addr.IP
 	}
 
-	ips, _ := ips.Load().([]net.IPNet)
-	for _, ipnet := range ips {
-		if ipnet.Contains(ip) {
-			return true
-		}
+	// IPv6 zones are ignored, and v4-mapped addresses (::ffff:1.2.3.4)
+	// are matched against the IPv4 ranges
+	return f.IsCloudflareIP(ip)
+}
+
+// IsCloudflareIP reports whether ip belongs to Cloudflare.
+func IsCloudflareIP(ip net.IP) bool {
+	return defaultFilter.IsCloudflareIP(ip)
+}
+
+// IsCloudflareIP reports whether ip is in the filter's IP ranges.
+//
+// As with accepted connections, the ranges are fetched if needed,
+// and refreshed (at most once an hour) if ip isn't found.
+func (f *Filter) IsCloudflareIP(ip net.IP) bool {
+	ips, _ := f.ips.Load().(*ipRanges)
+	if ips.contains(ip) {
+		return true
 	}
 	// update on failure: maybe it's a new IP?
-	for _, ipnet := range updateIPs() {
-		if ipnet.Contains(ip) {
-			return true
-		}
-	}
+	return f.updateIPs().contains(ip)
+}
 
-	return false
+// MatchCloudflareIP reports whether ip belongs to Cloudflare,
+// and which CIDR it matched.
+func MatchCloudflareIP(ip net.IP) (*net.IPNet, bool) {
+	return defaultFilter.MatchCloudflareIP(ip)
 }
 
-func updateIPs() []net.IPNet {
-	// shared state
-	mutex.Lock()
-	defer mutex.Unlock()
+// MatchCloudflareIP reports whether ip is in the filter's IP ranges,
+// and the most specific CIDR it matched.
+//
+// Usage:
+//
+//	if n, ok := origin.MatchCloudflareIP(ip); ok {
+//		fmt.Println(ip, "matched", n)
+//	}
+func (f *Filter) MatchCloudflareIP(ip net.IP) (*net.IPNet, bool) {
+	ips, _ := f.ips.Load().(*ipRanges)
+	n := ips.match(ip)
+	if n == nil {
+		n = f.updateIPs().match(ip)
+	}
+	if n == nil {
+		return nil, false
+	}
+	return &net.IPNet{IP: n.IP, Mask: n.Mask}, true
+}
 
-	// update at most once an hour, even if it fails
-	if time.Since(refresh) > time.Hour {
-		refresh = time.Now()
+// SetIPRanges replaces the filter's IP ranges with a fixed set,
+// which is never refreshed.
+func (f *Filter) SetIPRanges(nets ...net.IPNet) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
 
-		ipv4, err := loadIPs("https://www.cloudflare.com/ips-v4")
-		if err != nil {
-			if ips.Load() == nil {
-				// fatal because it's our first time doing this
-				log.Fatalln("failed to fecth Cloudflare IPv4s:", err)
-			}
-			log.Println("failed to update Cloudflare IPv4s:", err)
-			return nil
+	f.static = true
+	f.next.Store(math.MaxInt64)
+	f.ips.Store(newIPRanges(nets))
+	f.updated.Store(time.Now())
+}
+
+func (f *Filter) refreshIPs(done <-chan struct{}) {
+	f.updateIPs()
+
+	// updateIPs refreshes at most once an hour
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.updateIPs()
+		case <-done:
+			return
 		}
-		ipv6, err := loadIPs("https://www.cloudflare.com/ips-v6")
+	}
+}
+
+func (f *Filter) updateIPs() *ipRanges {
+	// skip the lock until a refresh is due,
+	// so checking IPs outside the ranges doesn't contend
+	if time.Now().UnixNano() < f.next.Load() {
+		ips, _ := f.ips.Load().(*ipRanges)
+		return ips
+	}
+
+	// shared state
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.static && time.Since(f.refresh) > f.refreshInterval() {
+		ips, err := f.reloadIPs(context.Background())
 		if err != nil {
-			if ips.Load() == nil {
-				// fatal because it's our first time doing this
-				log.Fatalln("failed to fecth Cloudflare IPv6s:", err)
-			}
-			log.Println("failed to update Cloudflare IPv6s:", err)
+			// without ranges, all connections are rejected
+			log.Println("failed to update Cloudflare IPs:", err)
 			return nil
 		}
-
-		ip := append(ipv4, ipv6...)
-		ips.Store(ip)
-		return ip
+		return ips
 	}
 
 	// another routine might've updated it
-	return ips.Load().([]net.IPNet)
+	ips, _ := f.ips.Load().(*ipRanges)
+	return ips
+}
+
+// refreshInterval is how often the IP ranges are refreshed:
+// at most once an hour, even if it fails;
+// until the first success, retry every minute.
+func (f *Filter) refreshInterval() time.Duration {
+	if f.ips.Load() == nil {
+		return time.Minute
+	}
+	return time.Hour
+}
+
+// warmIPs fetches the IP ranges, unless they're already loaded.
+func (f *Filter) warmIPs() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.static || f.ips.Load() != nil {
+		return nil
+	}
+	_, err := f.reloadIPs(context.Background())
+	return err
 }
 
-func loadIPs(url string) ([]net.IPNet, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+// reloadIPs fetches and stores the IP ranges.
+// Called with the mutex held.
+func (f *Filter) reloadIPs(ctx context.Context) (*ipRanges, error) {
+	f.refresh = time.Now()
+	metrics.ipRefreshes.Add(1)
+
+	nets, err := f.fetchIPs(ctx)
+	defer func() { f.next.Store(f.refresh.Add(f.refreshInterval()).UnixNano()) }()
+	if err != nil {
+		metrics.ipRefreshFailures.Add(1)
+		return nil, err
+	}
+
+	ips, _ := f.ips.Load().(*ipRanges)
+	if nets != nil {
+		ips = newIPRanges(append(nets, f.ExtraRanges...))
+		f.ips.Store(ips)
+	}
+	f.updated.Store(time.Now())
+	return ips, nil
+}
+
+// fetchIPs fetches the IP ranges from the filter's source.
+// It returns nil ranges if they're unchanged since the last fetch.
+func (f *Filter) fetchIPs(ctx context.Context) ([]net.IPNet, error) {
+	if f.UseJSONAPI || f.API != nil {
+		return f.fetchAPI(ctx)
+	}
+
+	ipv4URL, ipv6URL := f.IPv4URL, f.IPv6URL
+	if ipv4URL == "" {
+		ipv4URL = defaultIPv4URL
+	}
+	if ipv6URL == "" {
+		ipv6URL = defaultIPv6URL
+	}
+
+	ipv4, err := loadIPs(ctx, ipv4URL, f.ipv4)
+	if err != nil {
+		return nil, fmt.Errorf("IPv4s: %w", err)
+	}
+	ipv6, err := loadIPs(ctx, ipv6URL, f.ipv6)
+	if err != nil {
+		return nil, fmt.Errorf("IPv6s: %w", err)
+	}
+
+	// both not modified
+	if ipv4 == f.ipv4 && ipv6 == f.ipv6 {
+		return nil, nil
+	}
+	f.ipv4, f.ipv6 = ipv4, ipv6
+	return append(append([]net.IPNet(nil), ipv4.nets...), ipv6.nets...), nil
+}
+
+// ipList is an IP list, along with the validators to conditionally refresh it.
+type ipList struct {
+	nets         []net.IPNet
+	etag         string
+	lastModified string
+}
+
+// loadIPs loads an IP list from url.
+// If prev is not modified, it is returned.
+func loadIPs(ctx context.Context, url string, prev *ipList) (*ipList, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
+	if prev != nil {
+		if prev.etag != "" {
+			req.Header.Set("If-None-Match", prev.etag)
+		}
+		if prev.lastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.lastModified)
+		}
+	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotModified && prev != nil {
+		return prev, nil
+	}
 	if res.StatusCode != http.StatusOK {
 		return nil, errors.New(res.Status)
 	}
 
-	var ips []net.IPNet
-	scanner := bufio.NewScanner(res.Body)
+	list := ipList{
+		etag:         res.Header.Get("ETag"),
+		lastModified: res.Header.Get("Last-Modified"),
+	}
+	list.nets, err = parseIPList(res.Body)
+	if err != nil && len(list.nets) == 0 {
+		return nil, err
+	}
+	if len(list.nets) == 0 {
+		return nil, ErrNoRanges
+	}
+	if err != nil {
+		log.Println("ignoring malformed Cloudflare IPs:", err)
+	}
+	return &list, nil
+}
+
+// parseIPList parses a list of CIDRs, one per line.
+// Blank lines, and lines starting with #, are skipped.
+// Malformed lines are reported in the error, without discarding the valid ones.
+func parseIPList(r io.Reader) ([]net.IPNet, error) {
+	var nets []net.IPNet
+	var errs []error
+
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		_, n, err := net.ParseCIDR(scanner.Text())
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		_, n, err := net.ParseCIDR(line)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
+			continue
 		}
-		ips = append(ips, *n)
+		nets = append(nets, *n)
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		errs = append(errs, err)
 	}
-	return ips, err
+	return nets, errors.Join(errs...)
 }
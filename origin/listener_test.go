@@ -1,8 +1,17 @@
 package origin
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_checkIP(t *testing.T) {
@@ -18,3 +27,318 @@ func Test_checkIP(t *testing.T) {
 		t.Errorf("not a Cloudflare IP: %v", addr)
 	}
 }
+
+func TestListen_unix(t *testing.T) {
+	ln, err := Listen("unix", filepath.Join(t.TempDir(), "origin.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("unix", ln.Addr().String())
+		if err == nil {
+			c.Write([]byte("ok"))
+			c.Close()
+		}
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var buf [2]byte
+	if _, err := io.ReadFull(c, buf[:]); err != nil {
+		t.Error(err)
+	}
+}
+
+var testCIDRs = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+	"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+	"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+	"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+}
+
+func testNets(tb testing.TB) []net.IPNet {
+	var nets []net.IPNet
+	for _, s := range testCIDRs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		nets = append(nets, *n)
+	}
+	return nets
+}
+
+func TestFilter_fetchIPs(t *testing.T) {
+	var notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + r.URL.Path + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		switch r.URL.Path {
+		case "/ips-v4":
+			io.WriteString(w, "192.0.2.0/24\n198.51.100.0/24")
+		case "/empty":
+			io.WriteString(w, "# no ranges\n")
+		default:
+			io.WriteString(w, "2001:db8::/32")
+		}
+	}))
+	defer srv.Close()
+
+	f := Filter{IPv4URL: srv.URL + "/ips-v4", IPv6URL: srv.URL + "/ips-v6"}
+	nets, err := f.fetchIPs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 {
+		t.Errorf("got %v", nets)
+	}
+
+	// unchanged
+	nets, err = f.fetchIPs(context.Background())
+	if err != nil || nets != nil || notModified != 2 {
+		t.Errorf("got %v, %v, %d", nets, err, notModified)
+	}
+
+	// empty
+	f = Filter{IPv4URL: srv.URL + "/ips-v4", IPv6URL: srv.URL + "/empty"}
+	if _, err := f.fetchIPs(context.Background()); !errors.Is(err, ErrNoRanges) {
+		t.Errorf("got %v, want %v", err, ErrNoRanges)
+	}
+}
+
+func TestFilter_fetchIPs_context(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	f := Filter{IPv4URL: srv.URL + "/ips-v4", IPv6URL: srv.URL + "/ips-v6"}
+	if _, err := f.fetchIPs(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFilter_checkIP(t *testing.T) {
+	var f Filter
+	f.SetIPRanges(testNets(t)...)
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("104.16.1.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:104.16.1.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:8.8.8.8")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2606:4700::1"), Zone: "eth0"}, true},
+		{&net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, false},
+		{&net.UnixAddr{Name: "/tmp/origin.sock", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		if got := f.checkIP(tt.addr); got != tt.want {
+			t.Errorf("checkIP(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestFilter_MatchCloudflareIP(t *testing.T) {
+	var f Filter
+	f.SetIPRanges(append(testNets(t), net.IPNet{
+		IP:   net.ParseIP("104.16.0.0").To4(),
+		Mask: net.CIDRMask(16, 32),
+	})...)
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"104.16.1.1", "104.16.0.0/16"},
+		{"::ffff:104.17.1.1", "104.16.0.0/13"},
+		{"2606:4700::1", "2606:4700::/32"},
+		{"8.8.8.8", ""},
+	}
+	for _, tt := range tests {
+		n, ok := f.MatchCloudflareIP(net.ParseIP(tt.ip))
+		if ok != (tt.want != "") || ok && n.String() != tt.want {
+			t.Errorf("MatchCloudflareIP(%s) = %v, %v, want %q", tt.ip, n, ok, tt.want)
+		}
+		if f.IsCloudflareIP(net.ParseIP(tt.ip)) != ok {
+			t.Errorf("IsCloudflareIP(%s) = %v", tt.ip, !ok)
+		}
+	}
+}
+
+func Test_parseIPList(t *testing.T) {
+	nets, err := parseIPList(strings.NewReader("# comment\n\n 192.0.2.0/24 \r\njunk\n2001:db8::/32\n"))
+	if len(nets) != 2 || nets[0].String() != "192.0.2.0/24" || nets[1].String() != "2001:db8::/32" {
+		t.Errorf("got %v", nets)
+	}
+	var perr *net.ParseError
+	if !errors.As(err, &perr) || perr.Text != "junk" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func FuzzParseIPList(f *testing.F) {
+	f.Add("173.245.48.0/20\n103.21.244.0/22\n")
+	f.Add("2400:cb00::/32\r\n\n# comment\n")
+	f.Add("::ffff:1.2.3.4/120\n1.2.3.4/33\n")
+	f.Fuzz(func(t *testing.T, list string) {
+		nets, _ := parseIPList(strings.NewReader(list))
+		newIPRanges(nets).contains(net.IPv4(1, 2, 3, 4))
+	})
+}
+
+func TestFilter_OnReject(t *testing.T) {
+	var f Filter
+	_, n, _ := net.ParseCIDR("192.0.2.0/24")
+	f.SetIPRanges(*n)
+
+	var rejected net.Addr
+	f.OnReject = func(addr net.Addr) { rejected = addr }
+
+	ln, err := f.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("tcp4", ln.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if addr, ok := rejected.(*net.TCPAddr); !ok || !addr.IP.IsLoopback() {
+		t.Errorf("got %v", rejected)
+	}
+}
+
+func TestFilter_MaxConns(t *testing.T) {
+	var f Filter
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	f.SetIPRanges(*n)
+	f.MaxConns = 1
+
+	ln, err := f.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	first, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	select {
+	case <-accepted:
+		t.Fatal("accepted over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Close()
+	first.Close() // releases once
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("not accepted after close")
+	}
+}
+
+func TestServe(t *testing.T) {
+	cert := testCertificate(t)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, docs, _ := net.ParseCIDR("192.0.2.0/24")
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name   string
+		filter func(f *Filter)
+		want   bool
+	}{
+		{"allowed", func(f *Filter) { f.SetIPRanges(*loopback) }, true},
+		{"rejected", func(f *Filter) { f.SetIPRanges(*docs) }, false},
+		// failing to fetch the ranges rejects, rather than exits
+		{"unavailable", func(f *Filter) { f.IPv4URL, f.IPv6URL = down.URL, down.URL }, false},
+	}
+	for _, tt := range tests {
+		var f Filter
+		tt.filter(&f)
+		ln, err := f.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := NewServerWithCerts(nil, cert)
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		go server.ServeTLS(ln, "", "")
+
+		client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+		}}}
+		res, err := client.Get("https://" + ln.Addr().String())
+		if err == nil {
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("%s: got %d", tt.name, res.StatusCode)
+			}
+			res.Body.Close()
+		}
+		if got := err == nil; got != tt.want {
+			t.Errorf("%s: request succeeded = %v, want %v (%v)", tt.name, got, tt.want, err)
+		}
+		client.CloseIdleConnections()
+		server.Close()
+	}
+}
+
+func BenchmarkFilter_IsCloudflareIP(b *testing.B) {
+	var f Filter
+	f.SetIPRanges(testNets(b)...)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.IsCloudflareIP(benchIPs[i%len(benchIPs)])
+	}
+}
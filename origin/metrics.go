@@ -0,0 +1,41 @@
+package origin
+
+import "sync/atomic"
+
+// Metrics are counters of rejected connections and IP range refreshes.
+//
+// The counters are global: they add up the connections, handshakes and refreshes
+// of every Filter (not just the default one) and every server in the process.
+//
+// They can be exported to expvar, Prometheus, etc. For example:
+//
+//	expvar.Publish("origin", expvar.Func(func() any { return origin.ReadMetrics() }))
+type Metrics struct {
+	RejectedIP        int64 `json:"cf_origin_rejected_ip_total"`         // connections from non-Cloudflare IPs
+	MissingSNI        int64 `json:"cf_origin_missing_sni_total"`         // handshakes without SNI
+	SNIMismatch       int64 `json:"cf_origin_sni_mismatch_total"`        // handshakes with SNI not matching any certificate
+	HostMismatch      int64 `json:"cf_origin_host_mismatch_total"`       // requests with Host not matching SNI
+	IPRefreshes       int64 `json:"cf_origin_ip_refreshes_total"`        // attempts to refresh the IP ranges
+	IPRefreshFailures int64 `json:"cf_origin_ip_refresh_failures_total"` // failed attempts to refresh the IP ranges
+}
+
+var metrics struct {
+	rejectedIP        atomic.Int64
+	missingSNI        atomic.Int64
+	sniMismatch       atomic.Int64
+	hostMismatch      atomic.Int64
+	ipRefreshes       atomic.Int64
+	ipRefreshFailures atomic.Int64
+}
+
+// ReadMetrics returns a snapshot of the package's global counters.
+func ReadMetrics() Metrics {
+	return Metrics{
+		RejectedIP:        metrics.rejectedIP.Load(),
+		MissingSNI:        metrics.missingSNI.Load(),
+		SNIMismatch:       metrics.sniMismatch.Load(),
+		HostMismatch:      metrics.hostMismatch.Load(),
+		IPRefreshes:       metrics.ipRefreshes.Load(),
+		IPRefreshFailures: metrics.ipRefreshFailures.Load(),
+	}
+}
@@ -0,0 +1,36 @@
+package origin
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReadMetrics(t *testing.T) {
+	var f Filter
+	_, n, _ := net.ParseCIDR("192.0.2.0/24")
+	f.SetIPRanges(*n)
+
+	ln, err := f.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("tcp4", ln.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	// a rejected connection is counted, even with a non-default Filter
+	before := ReadMetrics().RejectedIP
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if got := ReadMetrics().RejectedIP - before; got != 1 {
+		t.Errorf("got %d rejected, want 1", got)
+	}
+}
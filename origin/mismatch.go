@@ -0,0 +1,61 @@
+package origin
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// A HostMismatch describes a request whose Host header doesn't match its SNI,
+// likely direct access to the origin, or a misrouted request.
+type HostMismatch struct {
+	ServerName string // the SNI of the connection
+	Host       string // the Host header of the request
+}
+
+type mismatchHandlerKey struct{}
+type hostMismatchKey struct{}
+
+type mismatchHandlerOption struct{ handler http.Handler }
+
+func (o mismatchHandlerOption) apply(s *http.Server) {
+	connContext := s.ConnContext
+	s.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return context.WithValue(ctx, mismatchHandlerKey{}, o.handler)
+	}
+}
+
+// MismatchHandler serves requests whose Host header doesn't match SNI with handler,
+// instead of rejecting them with 403 Forbidden.
+// The handler can get the details with HostMismatchFromContext,
+// e.g. to log them, and should respond with an error status.
+//
+// Usage:
+//
+//	origin.MismatchHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//		m, _ := origin.HostMismatchFromContext(r.Context())
+//		log.Printf("host mismatch from %s: SNI %q, Host %q", r.RemoteAddr, m.ServerName, m.Host)
+//		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+//	}))
+func MismatchHandler(handler http.Handler) ServerOption {
+	return mismatchHandlerOption{handler}
+}
+
+// HostMismatchFromContext returns the mismatch of a request served by a MismatchHandler.
+func HostMismatchFromContext(ctx context.Context) (*HostMismatch, bool) {
+	m, ok := ctx.Value(hostMismatchKey{}).(*HostMismatch)
+	return m, ok
+}
+
+func serveMismatch(w http.ResponseWriter, r *http.Request) {
+	handler, _ := r.Context().Value(mismatchHandlerKey{}).(http.Handler)
+	if handler == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	m := &HostMismatch{ServerName: r.TLS.ServerName, Host: r.Host}
+	handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), hostMismatchKey{}, m)))
+}
@@ -0,0 +1,35 @@
+package origin
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMismatchHandler(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	var got *HostMismatch
+	server := NewStrictServer(handler, nil, []tls.Certificate{testCertificate(t)},
+		MismatchHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = HostMismatchFromContext(r.Context())
+			w.WriteHeader(http.StatusMisdirectedRequest)
+		})))
+
+	for host, want := range map[string]int{
+		"example.com":      http.StatusOK,
+		"attacker.example": http.StatusMisdirectedRequest,
+	} {
+		r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+		r.TLS = &tls.ConnectionState{ServerName: "example.com"}
+		r = r.WithContext(server.ConnContext(r.Context(), nil))
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", host, w.Code, want)
+		}
+	}
+	if got == nil || got.ServerName != "example.com" || got.Host != "attacker.example" {
+		t.Errorf("got %+v", got)
+	}
+}
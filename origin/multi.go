@@ -0,0 +1,105 @@
+package origin
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// ListenAll is like Listen, but listens on several addresses,
+// returning a listener that accepts connections from any of them.
+//
+// The IP ranges are refreshed by a single background loop,
+// and the listener can be served by a single http.Server.
+// Its Addr is that of the first address.
+func ListenAll(network string, addresses ...string) (net.Listener, error) {
+	return defaultFilter.ListenAll(network, addresses...)
+}
+
+// ListenAll is like Listen, but listens on several addresses.
+func (f *Filter) ListenAll(network string, addresses ...string) (net.Listener, error) {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: nil, Err: &net.AddrError{Err: "unexpected address type", Addr: strings.Join(addresses, ",")}}
+	}
+	if len(addresses) == 0 {
+		return nil, &net.OpError{Op: "listen", Net: network, Source: nil, Addr: nil, Err: errors.New("no addresses")}
+	}
+
+	var lns []net.Listener
+	for _, address := range addresses {
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return f.NewListener(newMultiListener(lns)), nil
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener accepts connections from several listeners.
+type multiListener struct {
+	lns     []net.Listener
+	accepts chan acceptResult
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newMultiListener(lns []net.Listener) *multiListener {
+	m := &multiListener{
+		lns:     lns,
+		accepts: make(chan acceptResult),
+		done:    make(chan struct{}),
+	}
+	for _, ln := range lns {
+		go m.serve(ln)
+	}
+	return m
+}
+
+func (m *multiListener) serve(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		select {
+		case m.accepts <- acceptResult{c, err}:
+		case <-m.done:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-m.accepts:
+		return r.conn, r.err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var errs []error
+	m.once.Do(func() {
+		close(m.done)
+		for _, ln := range m.lns {
+			errs = append(errs, ln.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func (m *multiListener) Addr() net.Addr { return m.lns[0].Addr() }
@@ -0,0 +1,42 @@
+package origin
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestFilter_ListenAll(t *testing.T) {
+	var f Filter
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	f.SetIPRanges(*n)
+
+	ln, err := f.ListenAll("tcp4", "127.0.0.1:0", "127.0.0.2:0")
+	if err != nil {
+		t.Skip(err) // 127.0.0.2 may be unavailable
+	}
+	defer ln.Close()
+
+	multi := ln.(*listener).Listener.(*multiListener)
+	for _, l := range multi.lns {
+		go func(addr string) {
+			c, err := net.Dial("tcp4", addr)
+			if err == nil {
+				c.Close()
+			}
+		}(l.Addr().String())
+	}
+
+	for range multi.lns {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,356 @@
+package origin
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// A ServerOption customizes the server created by NewServerWithOptions.
+type ServerOption interface {
+	apply(*http.Server)
+}
+
+type addrOption string
+
+func (o addrOption) apply(s *http.Server) { s.Addr = string(o) }
+
+// Addr sets the TCP address for the server to listen on, ":https" if empty.
+func Addr(addr string) ServerOption { return addrOption(addr) }
+
+type (
+	readHeaderTimeoutOption time.Duration
+	readTimeoutOption       time.Duration
+	writeTimeoutOption      time.Duration
+	idleTimeoutOption       time.Duration
+)
+
+func (o readHeaderTimeoutOption) apply(s *http.Server) { s.ReadHeaderTimeout = time.Duration(o) }
+func (o readTimeoutOption) apply(s *http.Server)       { s.ReadTimeout = time.Duration(o) }
+func (o writeTimeoutOption) apply(s *http.Server)      { s.WriteTimeout = time.Duration(o) }
+func (o idleTimeoutOption) apply(s *http.Server)       { s.IdleTimeout = time.Duration(o) }
+
+// ReadHeaderTimeout overrides the default 5 second http.Server.ReadHeaderTimeout.
+// Zero means ReadTimeout is used, and if both are zero, there is no timeout.
+func ReadHeaderTimeout(d time.Duration) ServerOption { return readHeaderTimeoutOption(d) }
+
+// ReadTimeout overrides the default 1 minute http.Server.ReadTimeout.
+// Zero or negative means there is no timeout.
+func ReadTimeout(d time.Duration) ServerOption { return readTimeoutOption(d) }
+
+// WriteTimeout overrides the default 1 minute http.Server.WriteTimeout.
+// Zero or negative means there is no timeout.
+func WriteTimeout(d time.Duration) ServerOption { return writeTimeoutOption(d) }
+
+// IdleTimeout overrides the default 10 minute http.Server.IdleTimeout.
+// Zero means ReadTimeout is used, and if both are zero, there is no timeout.
+func IdleTimeout(d time.Duration) ServerOption { return idleTimeoutOption(d) }
+
+type defaultCertificateOption struct{ cert tls.Certificate }
+
+func (o *defaultCertificateOption) apply(s *http.Server) {
+	getCertificate := s.TLSConfig.GetCertificate
+	s.TLSConfig.GetCertificate = func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if info.ServerName == "" {
+			return &o.cert, nil
+		}
+		return getCertificate(info)
+	}
+}
+
+// DefaultCertificate serves cert to clients that don't send SNI,
+// instead of failing the handshake.
+//
+// Cloudflare always sends SNI, but some testing tools and health checkers don't.
+// Requests without SNI are not checked against the Host header;
+// handshakes with an SNI that matches no certificate still fail.
+func DefaultCertificate(cert tls.Certificate) ServerOption {
+	return &defaultCertificateOption{cert}
+}
+
+type getCertificateOption func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+func (o getCertificateOption) apply(s *http.Server) {
+	getCertificate := s.TLSConfig.GetCertificate
+	s.TLSConfig.GetCertificate = func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if info.ServerName != "" {
+			cert, err := o(info)
+			if err != nil {
+				return nil, err
+			}
+			if cert != nil && info.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+		return getCertificate(info)
+	}
+}
+
+// GetCertificate serves the certificates returned by get,
+// e.g. certificates that are renewed while the server runs,
+// falling back to the server's loaded certificates.
+//
+// Certificates that don't match the client's SNI are not served.
+// With this option, the server can be created without loaded certificates.
+//
+// Usage:
+//
+//	origin.NewServerWithOptions(pullCA, nil, origin.GetCertificate(managed.GetCertificate))
+func GetCertificate(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) ServerOption {
+	return getCertificateOption(get)
+}
+
+type nextProtosOption []string
+
+func (o nextProtosOption) apply(s *http.Server) {
+	s.TLSConfig.NextProtos = append([]string(nil), o...)
+	for _, p := range o {
+		if p == "h2" {
+			return
+		}
+	}
+	// don't let net/http configure HTTP/2
+	s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+}
+
+// NextProtos sets the protocols the server offers through ALPN, in order of preference.
+//
+// By default, the server offers HTTP/2 and HTTP/1.1.
+// Leaving out "h2" disables HTTP/2; to offer other protocols,
+// register their handlers in http.Server.TLSNextProto.
+// http.Server.ServeTLS always offers "http/1.1".
+//
+// Usage:
+//
+//	origin.NewServerWithOptions(pullCA, certs, origin.NextProtos("http/1.1"))
+func NextProtos(protos ...string) ServerOption { return nextProtosOption(protos) }
+
+type streamingOption time.Duration
+
+func (o streamingOption) apply(s *http.Server) {
+	idle := time.Duration(o)
+	handler := s.Handler
+	s.WriteTimeout = 0
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &streamWriter{ResponseWriter: w, idle: idle}
+		sw.extend()
+		handler.ServeHTTP(sw, r)
+	})
+}
+
+// Streaming replaces the server's WriteTimeout, which bounds the time to write a whole response,
+// with a write deadline that's extended by idle on each write or flush.
+//
+// This allows Server-Sent Events and long downloads,
+// while still dropping clients that stop reading.
+// Apply it after other options that change the WriteTimeout or Handler.
+func Streaming(idle time.Duration) ServerOption { return streamingOption(idle) }
+
+type streamWriter struct {
+	http.ResponseWriter
+	idle time.Duration
+}
+
+func (w *streamWriter) extend() {
+	http.NewResponseController(w.ResponseWriter).SetWriteDeadline(time.Now().Add(w.idle))
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *streamWriter) Flush() {
+	w.extend()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack allows handlers that type assert http.Hijacker (e.g. for WebSockets)
+// to take over the connection; net/http clears its deadlines.
+func (w *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+type filterPeersOption struct{ filter *Filter }
+
+func (o filterPeersOption) apply(s *http.Server) {
+	getConfigForClient := s.TLSConfig.GetConfigForClient
+	s.TLSConfig.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		// only TCP peers have IPs to check
+		if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok && !o.filter.checkIP(addr) {
+			metrics.rejectedIP.Add(1)
+			o.filter.reject(addr)
+			return nil, ErrNotCloudflare
+		}
+		if getConfigForClient != nil {
+			return getConfigForClient(info)
+		}
+		return nil, nil
+	}
+}
+
+// FilterPeers aborts handshakes from peers that aren't in the filter's IP ranges
+// (or Cloudflare's, if filter is nil), before a certificate is selected.
+//
+// This makes the server safe to use with any listener, e.g. one from net.Listen.
+// The listeners from this package filter connections earlier, before the handshake starts.
+func FilterPeers(filter *Filter) ServerOption {
+	if filter == nil {
+		filter = &defaultFilter
+	}
+	return filterPeersOption{filter}
+}
+
+type clientAuthOption func(net.Addr) tls.ClientAuthType
+
+func (o clientAuthOption) apply(s *http.Server) {
+	config := s.TLSConfig
+	getConfigForClient := config.GetConfigForClient
+	config.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		base := config
+		if getConfigForClient != nil {
+			c, err := getConfigForClient(info)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				base = c
+			}
+		}
+		c := base.Clone()
+		c.ClientAuth = o(info.Conn.RemoteAddr())
+		// without an origin pull CA, don't fall back to the system roots
+		if c.ClientCAs == nil {
+			c.ClientCAs = x509.NewCertPool()
+		}
+		return c, nil
+	}
+}
+
+// ClientAuthPolicy decides, for each connection, the client certificate policy
+// based on the peer address, instead of requiring a certificate from every peer
+// whenever an origin pull CA is given.
+// Client certificates are verified against the origin pull CA (and those added by ClientCAs);
+// without either, no certificate verifies, so policies that verify certificates reject them all.
+//
+// Usage, to require client certificates only from peers that aren't Cloudflare
+// (e.g. direct access, bypassing Tunnel):
+//
+//	origin.ClientAuthPolicy(func(addr net.Addr) tls.ClientAuthType {
+//		if a, ok := addr.(*net.TCPAddr); ok && origin.IsCloudflareIP(a.IP) {
+//			return tls.NoClientCert
+//		}
+//		return tls.RequireAndVerifyClientCert
+//	})
+func ClientAuthPolicy(policy func(addr net.Addr) tls.ClientAuthType) ServerOption {
+	return clientAuthOption(policy)
+}
+
+type pullCAKey struct{}
+
+type clientCAsOption struct {
+	pool   *x509.CertPool
+	system bool
+}
+
+func (o clientCAsOption) apply(s *http.Server) {
+	config := s.TLSConfig
+
+	var roots []*x509.CertPool
+	for _, pool := range []*x509.CertPool{config.ClientCAs, o.pool} {
+		if pool != nil {
+			roots = append(roots, pool)
+		}
+	}
+	if o.system {
+		if pool, err := x509.SystemCertPool(); err == nil {
+			roots = append(roots, pool)
+		}
+	}
+
+	// certificates are verified below, against each pool in turn
+	if config.ClientAuth == tls.NoClientCert {
+		config.ClientAuth = tls.RequireAnyClientCert
+	}
+	config.ClientAuth = unverifiedClientAuth(config.ClientAuth)
+	getConfigForClient := config.GetConfigForClient
+	if getConfigForClient != nil {
+		config.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := getConfigForClient(info)
+			if c != nil && c.ClientAuth != unverifiedClientAuth(c.ClientAuth) {
+				c = c.Clone()
+				c.ClientAuth = unverifiedClientAuth(c.ClientAuth)
+			}
+			return c, err
+		}
+	}
+
+	verifyConnection := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) > 0 {
+			chains, err := verifyClientCert(cs.PeerCertificates, roots)
+			if err != nil {
+				return err
+			}
+			// let later checks (e.g. CheckRevocation) see the verified chains
+			cs.VerifiedChains = chains
+		}
+		if verifyConnection != nil {
+			return verifyConnection(cs)
+		}
+		return nil
+	}
+}
+
+// unverifiedClientAuth is the policy that requests the same client certificates,
+// but leaves verifying them to VerifyConnection.
+func unverifiedClientAuth(auth tls.ClientAuthType) tls.ClientAuthType {
+	switch auth {
+	case tls.RequireAndVerifyClientCert:
+		return tls.RequireAnyClientCert
+	case tls.VerifyClientCertIfGiven:
+		return tls.RequestClientCert
+	}
+	return auth
+}
+
+func verifyClientCert(chain []*x509.Certificate, roots []*x509.CertPool) ([][]*x509.Certificate, error) {
+	opts := x509.VerifyOptions{
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	err := errors.New("no client certificate authorities")
+	for _, pool := range roots {
+		opts.Roots = pool
+		chains, verr := chain[0].Verify(opts)
+		if verr == nil {
+			return chains, nil
+		}
+		err = verr
+	}
+	return nil, err
+}
+
+// ClientCAs trusts pool (e.g. a corporate CA), and optionally the system's root CAs,
+// to verify client certificates, in addition to the origin pull CA.
+// This allows authenticating both Cloudflare (authenticated origin pulls),
+// and other clients (e.g. internal services with certificates from an enterprise CA).
+//
+// Client certificates are required, unless ClientAuthPolicy decides otherwise.
+// ClientCAs is applied after other options, so they can be placed in any order.
+func ClientCAs(pool *x509.CertPool, system bool) ServerOption {
+	return clientCAsOption{pool, system}
+}
@@ -0,0 +1,415 @@
+package origin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAddr(t *testing.T) {
+	// find a free port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	server := NewServerWithOptions(nil, []tls.Certificate{testCertificate(t)}, Addr(addr))
+	go server.ListenAndServeTLS("", "")
+	defer server.Close()
+
+	for deadline := time.Now().Add(time.Second); ; {
+		c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		if err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	server := NewServerWithOptions(nil, []tls.Certificate{testCertificate(t)},
+		ReadHeaderTimeout(100*time.Millisecond), ReadTimeout(0), WriteTimeout(0), IdleTimeout(time.Hour))
+	if server.ReadTimeout != 0 || server.WriteTimeout != 0 || server.IdleTimeout != time.Hour {
+		t.Errorf("got %v, %v, %v", server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// a client that never sends headers is dropped
+	start := time.Now()
+	c.SetReadDeadline(start.Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("dropped after %v", d)
+	}
+}
+
+func TestDefaultCertificate(t *testing.T) {
+	cert := tls.Certificate{Certificate: [][]byte{{}}}
+
+	server := NewServerWithCerts(nil, cert)
+	if _, err := server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{}); err != ErrMissingServerName {
+		t.Errorf("got %v, want %v", err, ErrMissingServerName)
+	}
+
+	server = NewServerWithOptions(nil, []tls.Certificate{cert}, DefaultCertificate(cert))
+	if got, err := server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{}); err != nil || got == nil {
+		t.Errorf("got %v, %v", got, err)
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	loaded := testCertificateFor(t, "example.com")
+	renewed := testCertificateFor(t, "example.com")
+	other := testCertificateFor(t, "example.org")
+
+	var current *tls.Certificate
+	server := NewServerWithOptions(nil, []tls.Certificate{loaded}, GetCertificate(
+		func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return current, nil }))
+
+	tests := []struct {
+		current *tls.Certificate
+		want    *tls.Certificate
+	}{
+		{nil, &loaded},
+		{&renewed, &renewed},
+		{&other, &loaded}, // doesn't match SNI
+	}
+	for _, tt := range tests {
+		current = tt.current
+		got, err := server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:        "example.com",
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		})
+		if err != nil || got.PrivateKey != tt.want.PrivateKey {
+			t.Errorf("got the wrong certificate (%v)", err)
+		}
+	}
+
+	// no SNI
+	current = &renewed
+	if _, err := server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{}); err != ErrMissingServerName {
+		t.Errorf("got %v, want %v", err, ErrMissingServerName)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "data: tick\n\n")
+			http.NewResponseController(w).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	Streaming(time.Second).apply(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(buf, []byte("tick")); n != 5 {
+		t.Errorf("got %d events", n)
+	}
+}
+
+func TestStreaming_hijack(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Error("not a Hijacker")
+			return
+		}
+		c, buf, err := hj.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+	}))
+	Streaming(time.Second).apply(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("got %d", res.StatusCode)
+	}
+}
+
+func TestFilterPeers(t *testing.T) {
+	cert := testCertificate(t)
+
+	for cidr, want := range map[string]bool{"127.0.0.0/8": true, "192.0.2.0/24": false} {
+		var f Filter
+		_, n, _ := net.ParseCIDR(cidr)
+		f.SetIPRanges(*n)
+
+		server := NewServerWithOptions(nil, []tls.Certificate{cert}, FilterPeers(&f))
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.ServeTLS(ln, "", "")
+
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		if err == nil {
+			c.Close()
+		}
+		if got := err == nil; got != want {
+			t.Errorf("%s: handshake succeeded = %v, want %v (%v)", cidr, got, want, err)
+		}
+		server.Close()
+	}
+}
+
+func TestNextProtos(t *testing.T) {
+	cert := testCertificate(t)
+
+	for want, options := range map[string][]ServerOption{
+		"h2":       nil,
+		"http/1.1": {NextProtos("http/1.1")},
+	} {
+		server := NewServerWithOptions(nil, []tls.Certificate{cert}, options...)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.ServeTLS(ln, "", "")
+
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			ServerName:         "example.com",
+			NextProtos:         []string{"h2", "http/1.1"},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ConnectionState().NegotiatedProtocol; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		c.Close()
+		server.Close()
+	}
+}
+
+func TestClientAuthPolicy(t *testing.T) {
+	cert := testCertificate(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	for auth, want := range map[tls.ClientAuthType]bool{
+		tls.NoClientCert:               true,
+		tls.RequireAndVerifyClientCert: false,
+	} {
+		server := NewServerWithOptions(pool, []tls.Certificate{cert},
+			ClientAuthPolicy(func(net.Addr) tls.ClientAuthType { return auth }))
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.ServeTLS(ln, "", "")
+
+		client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+		}}}
+		res, err := client.Get("https://" + ln.Addr().String())
+		if err == nil {
+			res.Body.Close()
+		}
+		if got := err == nil; got != want {
+			t.Errorf("%v: request succeeded = %v, want %v (%v)", auth, got, want, err)
+		}
+		client.CloseIdleConnections()
+		server.Close()
+	}
+}
+
+func TestClientAuthPolicy_noPullCA(t *testing.T) {
+	cert := testCertificate(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServerWithOptions(nil, []tls.Certificate{cert},
+		ClientAuthPolicy(func(net.Addr) tls.ClientAuthType { return tls.RequireAndVerifyClientCert }))
+
+	// certificates aren't verified against the system roots
+	c, _ := net.Pipe()
+	defer c.Close()
+	config, err := server.TLSConfig.GetConfigForClient(&tls.ClientHelloInfo{Conn: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientCAs == nil {
+		t.Error("verifying against the system roots")
+	}
+
+	// nor do they count as origin pulls
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf},
+		VerifiedChains:   [][]*x509.Certificate{{leaf}},
+	}
+	if IsOriginPullVerified(r) {
+		t.Error("origin pull verified without a pull CA")
+	}
+}
+
+func TestClientCAs(t *testing.T) {
+	pullCert, corpCert := testCertificate(t), testCertificate(t)
+	pool := func(cert tls.Certificate) *x509.CertPool {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(leaf)
+		return pool
+	}
+
+	server := NewServerWithOptions(pool(pullCert), []tls.Certificate{testCertificate(t)},
+		ClientCAs(pool(corpCert), false))
+	var verified bool
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verified = IsOriginPullVerified(r)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		cert []tls.Certificate
+		want bool
+	}{
+		{"pull", []tls.Certificate{pullCert}, true},
+		{"corporate", []tls.Certificate{corpCert}, true},
+		{"unknown", []tls.Certificate{testCertificate(t)}, false},
+		{"none", nil, false},
+	}
+	for _, tt := range tests {
+		verified = false
+		client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			ServerName:         "example.com",
+			Certificates:       tt.cert,
+			InsecureSkipVerify: true,
+		}}}
+		res, err := client.Get("https://" + ln.Addr().String())
+		if err == nil {
+			res.Body.Close()
+		}
+		if got := err == nil; got != tt.want {
+			t.Errorf("%s: request succeeded = %v, want %v (%v)", tt.name, got, tt.want, err)
+		}
+		if want := tt.name == "pull"; verified != want {
+			t.Errorf("%s: origin pull verified = %v, want %v", tt.name, verified, want)
+		}
+		client.CloseIdleConnections()
+	}
+}
+
+func TestClientCAs_clientAuthPolicy(t *testing.T) {
+	pullCert, corpCert := testCertificate(t), testCertificate(t)
+	pool := func(cert tls.Certificate) *x509.CertPool {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(leaf)
+		return pool
+	}
+	policy := ClientAuthPolicy(func(net.Addr) tls.ClientAuthType { return tls.RequireAndVerifyClientCert })
+
+	// in either order
+	for _, options := range [][]ServerOption{
+		{policy, ClientCAs(pool(corpCert), false)},
+		{ClientCAs(pool(corpCert), false), policy},
+	} {
+		server := NewServerWithOptions(pool(pullCert), []tls.Certificate{testCertificate(t)}, options...)
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.ServeTLS(ln, "", "")
+
+		for _, tt := range []struct {
+			name string
+			cert tls.Certificate
+			want bool
+		}{
+			{"corporate", corpCert, true},
+			{"unknown", testCertificate(t), false},
+		} {
+			client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				ServerName:         "example.com",
+				Certificates:       []tls.Certificate{tt.cert},
+				InsecureSkipVerify: true,
+			}}}
+			res, err := client.Get("https://" + ln.Addr().String())
+			if err == nil {
+				res.Body.Close()
+			}
+			if got := err == nil; got != tt.want {
+				t.Errorf("%s: request succeeded = %v, want %v (%v)", tt.name, got, tt.want, err)
+			}
+			client.CloseIdleConnections()
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,86 @@
+// Package origintest provides utilities for testing code that uses package origin,
+// without network access.
+//
+// Usage:
+//
+//	srv := origintest.NewServer([]string{"127.0.0.0/8"}, []string{"::1/128"})
+//	defer srv.Close()
+//
+//	ln, err := srv.Filter().Listen("tcp", "127.0.0.1:0")
+package origintest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/ncruces/go-cloudflare/origin"
+)
+
+// A Server is a fake Cloudflare IP ranges endpoint,
+// serving canned ips-v4 and ips-v6 lists.
+type Server struct {
+	*httptest.Server
+
+	mutex      sync.Mutex
+	ipv4, ipv6 []string
+}
+
+// NewServer starts and returns a Server serving the given CIDRs.
+// Both lists must be non-empty: filters reject empty lists with origin.ErrNoRanges.
+// The caller should call Close when finished, to shut it down.
+func NewServer(ipv4, ipv6 []string) *Server {
+	s := &Server{ipv4: ipv4, ipv6: ipv6}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ips-v4", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		io.WriteString(w, strings.Join(s.ipv4, "\n"))
+	})
+	mux.HandleFunc("/ips-v6", func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		io.WriteString(w, strings.Join(s.ipv6, "\n"))
+	})
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetRanges changes the CIDRs served.
+// As with NewServer, both lists must be non-empty.
+func (s *Server) SetRanges(ipv4, ipv6 []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ipv4, s.ipv6 = ipv4, ipv6
+}
+
+// Filter returns a new origin.Filter that fetches its IP ranges from s.
+func (s *Server) Filter() *origin.Filter {
+	return &origin.Filter{
+		IPv4URL: s.URL + "/ips-v4",
+		IPv6URL: s.URL + "/ips-v6",
+	}
+}
+
+// NewFilter returns a new origin.Filter with a fixed set of IP ranges,
+// which are never fetched.
+// It panics if a CIDR is invalid.
+func NewFilter(cidrs ...string) *origin.Filter {
+	var nets []net.IPNet
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, *n)
+	}
+
+	var f origin.Filter
+	f.SetIPRanges(nets...)
+	return &f
+}
@@ -0,0 +1,74 @@
+package origintest
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	srv := NewServer([]string{"127.0.0.0/8"}, []string{"::1/128"})
+	defer srv.Close()
+
+	testFilter(t, srv.Filter().Listen, true)
+}
+
+func TestNewFilter(t *testing.T) {
+	testFilter(t, NewFilter("127.0.0.1/32").Listen, true)
+	testFilter(t, NewFilter("192.0.2.0/24").Listen, false)
+}
+
+func testFilter(t *testing.T, listen func(network, address string) (net.Listener, error), accept bool) {
+	t.Helper()
+
+	ln, err := listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("tcp4", ln.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// rejected connections fail all reads and writes
+	_, err = c.Write(nil)
+	if accepted := err == nil; accepted != accept {
+		t.Errorf("accepted = %v, want %v (%v)", accepted, accept, err)
+	}
+}
+
+func TestFilter_ExtraRanges(t *testing.T) {
+	srv := NewServer([]string{"192.0.2.0/24"}, []string{"2001:db8::/32"})
+	defer srv.Close()
+
+	f := srv.Filter()
+	testFilter(t, f.Listen, false)
+
+	f = srv.Filter()
+	_, n, _ := net.ParseCIDR("127.0.0.0/8")
+	f.ExtraRanges = []net.IPNet{*n}
+	testFilter(t, f.Listen, true)
+}
+
+func TestFilter_ListenWarm(t *testing.T) {
+	srv := NewServer([]string{"127.0.0.0/8"}, []string{"::1/128"})
+	f := srv.Filter()
+	testFilter(t, f.ListenWarm, true)
+
+	// the server is down: fail, rather than fatal
+	srv.Close()
+	f = srv.Filter()
+	if ln, err := f.ListenWarm("tcp4", "127.0.0.1:0"); err == nil {
+		ln.Close()
+		t.Error("want error")
+	}
+}
@@ -0,0 +1,82 @@
+package origin
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// OriginPullCAURL is where Cloudflare publishes its origin pull CA certificate.
+const OriginPullCAURL = "https://developers.cloudflare.com/ssl/static/authenticated_origin_pull_ca.pem"
+
+// FallbackOriginPullCA is a PEM encoded copy of the origin pull CA certificate,
+// used by FetchOriginPullCA if the download fails.
+//
+// Applications can embed a copy of the certificate:
+//
+//	//go:embed origin-pull-ca.pem
+//	var pullCA []byte
+//
+//	func init() { origin.FallbackOriginPullCA = pullCA }
+var FallbackOriginPullCA []byte
+
+var pullCA struct {
+	sync.Mutex
+	pool *x509.CertPool
+}
+
+// FetchOriginPullCA downloads Cloudflare's origin pull CA certificate,
+// and returns a pool containing it, suitable for NewServerWithCerts.
+//
+// The pool is cached after the first successful download;
+// each call returns a copy, which callers can modify.
+// If the download fails, or has no certificates, FallbackOriginPullCA is used, if set.
+func FetchOriginPullCA(ctx context.Context) (*x509.CertPool, error) {
+	pullCA.Lock()
+	defer pullCA.Unlock()
+
+	if pullCA.pool != nil {
+		return pullCA.pool.Clone(), nil
+	}
+
+	pem, err := loadPullCA(ctx)
+	pool := x509.NewCertPool()
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		err = errors.New("no origin pull CA certificates found")
+	}
+	if err == nil {
+		pullCA.pool = pool
+		return pool.Clone(), nil
+	}
+
+	if FallbackOriginPullCA == nil {
+		return nil, err
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(FallbackOriginPullCA) {
+		return nil, errors.New("no origin pull CA certificates found in FallbackOriginPullCA")
+	}
+	return pool, nil
+}
+
+func loadPullCA(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, OriginPullCAURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
@@ -0,0 +1,67 @@
+package origin
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchOriginPullCA(t *testing.T) {
+	cert := testCertificate(t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	// send requests for OriginPullCAURL to srv
+	SetHTTPClient(&http.Client{Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+		return http.Get(srv.URL)
+	})})
+	defer SetHTTPClient(nil)
+	defer func() { pullCA.pool, FallbackOriginPullCA = nil, nil }()
+
+	want := x509.NewCertPool()
+	want.AddCert(leaf)
+
+	// a response without certificates fails, unless there's a fallback
+	body = "<html>maintenance</html>"
+	if _, err := FetchOriginPullCA(context.Background()); err == nil {
+		t.Error("want error")
+	}
+	FallbackOriginPullCA = certPEM
+	if pool, err := FetchOriginPullCA(context.Background()); err != nil || !pool.Equal(want) {
+		t.Errorf("fallback: got %v", err)
+	}
+	if pullCA.pool != nil {
+		t.Error("fallback cached")
+	}
+
+	// a download is cached, and callers get copies
+	FallbackOriginPullCA = nil
+	body = string(certPEM)
+	pool, err := FetchOriginPullCA(context.Background())
+	if err != nil || !pool.Equal(want) {
+		t.Fatalf("download: got %v", err)
+	}
+	other, _ := x509.ParseCertificate(testCertificate(t).Certificate[0])
+	pool.AddCert(other)
+	body = ""
+	if pool, err := FetchOriginPullCA(context.Background()); err != nil || !pool.Equal(want) {
+		t.Errorf("cached: got %v", err)
+	}
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
@@ -0,0 +1,117 @@
+package origin
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// ipRanges is a set of IP ranges, sorted and merged for binary search.
+type ipRanges struct {
+	v4, v6 []ipRange
+	count  int         // number of CIDRs the set was built from
+	nets   []net.IPNet // the CIDRs, to report matches
+}
+
+type ipRange struct {
+	first, last netip.Addr
+}
+
+func newIPRanges(nets []net.IPNet) *ipRanges {
+	var v4, v6 []ipRange
+	for _, n := range nets {
+		r, ok := cidrRange(n)
+		switch {
+		case !ok:
+			continue
+		case r.first.Is4():
+			v4 = append(v4, r)
+		default:
+			v6 = append(v6, r)
+		}
+	}
+	return &ipRanges{v4: mergeRanges(v4), v6: mergeRanges(v6), count: len(nets), nets: nets}
+}
+
+func (r *ipRanges) contains(ip net.IP) bool {
+	if r == nil {
+		return false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+
+	ranges := r.v6
+	if addr.Is4() {
+		ranges = r.v4
+	}
+	// first range that ends at or after addr
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].last.Compare(addr) >= 0
+	})
+	return i < len(ranges) && ranges[i].first.Compare(addr) <= 0
+}
+
+// match returns the most specific CIDR that contains ip, or nil.
+func (r *ipRanges) match(ip net.IP) *net.IPNet {
+	if !r.contains(ip) {
+		return nil
+	}
+	var best *net.IPNet
+	for i := range r.nets {
+		n := &r.nets[i]
+		if n.Contains(ip) && (best == nil || prefixLen(n) > prefixLen(best)) {
+			best = n
+		}
+	}
+	return best
+}
+
+func prefixLen(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+func cidrRange(n net.IPNet) (ipRange, bool) {
+	ip, ok := netip.AddrFromSlice(n.IP)
+	if !ok {
+		return ipRange{}, false
+	}
+	ones, bits := n.Mask.Size()
+	if bits == 0 {
+		return ipRange{}, false
+	}
+	ip = ip.Unmap()
+	if ip.BitLen() != bits {
+		return ipRange{}, false
+	}
+
+	first := netip.PrefixFrom(ip, ones).Masked().Addr()
+	last := first.AsSlice()
+	for i := ones; i < bits; i++ {
+		last[i/8] |= 0x80 >> (i % 8)
+	}
+	end, _ := netip.AddrFromSlice(last)
+	return ipRange{first, end}, true
+}
+
+// mergeRanges sorts ranges, and merges overlapping (e.g. nested) ones.
+func mergeRanges(ranges []ipRange) []ipRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first.Less(ranges[j].first)
+	})
+
+	var merged []ipRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].last.Compare(r.first) >= 0 {
+			if merged[n-1].last.Less(r.last) {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
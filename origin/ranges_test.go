@@ -0,0 +1,74 @@
+package origin
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_ipRanges(t *testing.T) {
+	nets := testNets(t)
+	// nested and duplicate ranges are merged
+	for _, s := range []string{"104.16.0.0/16", "104.16.0.0/13", "2606:4700:10::/48"} {
+		_, n, _ := net.ParseCIDR(s)
+		nets = append(nets, *n)
+	}
+	ranges := newIPRanges(nets)
+
+	if len(ranges.v4) != 15 || len(ranges.v6) != 7 {
+		t.Errorf("got %d+%d ranges", len(ranges.v4), len(ranges.v6))
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"104.16.0.0", true},
+		{"104.23.255.255", true},
+		{"104.24.0.1", true},
+		{"104.28.0.0", false},
+		{"173.245.63.255", true},
+		{"173.245.64.0", false},
+		{"8.8.8.8", false},
+		{"::ffff:104.16.1.1", true},
+		{"2606:4700::1111", true},
+		{"2606:4701::", false},
+		{"2a06:98c7:ffff::", true},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		if got := ranges.contains(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if ranges.contains(nil) {
+		t.Error("contains(nil) = true")
+	}
+}
+
+var benchIPs = []net.IP{
+	net.ParseIP("172.71.255.1"),
+	net.ParseIP("8.8.8.8"),
+	net.ParseIP("2c0f:f248::1"),
+	net.ParseIP("2001:4860:4860::8888"),
+}
+
+func BenchmarkCheckIP_linear(b *testing.B) {
+	nets := testNets(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip := benchIPs[i%len(benchIPs)]
+		for _, n := range nets {
+			if n.Contains(ip) {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkCheckIP_ranges(b *testing.B) {
+	ranges := newIPRanges(testNets(b))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ranges.contains(benchIPs[i%len(benchIPs)])
+	}
+}
@@ -0,0 +1,56 @@
+package origin
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RedirectHandler returns a handler that redirects requests
+// to the same URL with the HTTPS scheme, with 301 Moved Permanently.
+func RedirectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if host == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// ListenAndRedirect listens on the TCP address addr (":http" if empty),
+// and redirects requests from Cloudflare IP ranges to HTTPS.
+//
+// Usage:
+//
+//	go func() { log.Fatal(origin.ListenAndRedirect("")) }()
+func ListenAndRedirect(addr string) error {
+	return defaultFilter.ListenAndRedirect(addr)
+}
+
+// ListenAndRedirect listens on the TCP address addr (":http" if empty),
+// and redirects requests from the filter's IP ranges to HTTPS.
+func (f *Filter) ListenAndRedirect(addr string) error {
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := f.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           RedirectHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	return server.Serve(ln)
+}
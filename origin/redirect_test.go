@@ -0,0 +1,21 @@
+package origin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	for target, want := range map[string]string{
+		"http://example.com/path?q=1":   "https://example.com/path?q=1",
+		"http://example.com:8080/":      "https://example.com/",
+		"http://[2001:db8::1]:8080/a/b": "https://[2001:db8::1]/a/b",
+	} {
+		w := httptest.NewRecorder()
+		RedirectHandler().ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+			t.Errorf("%s: got %d %q, want %q", target, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+}
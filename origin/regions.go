@@ -0,0 +1,81 @@
+package origin
+
+import (
+	"net/http"
+	"strings"
+)
+
+// AllowColos returns middleware that only accepts requests
+// proxied by Cloudflare data centers in colos, given by their IATA codes (e.g. "LHR", "FRA").
+//
+// The data center is read from the suffix of the CF-Ray header,
+// which is only trusted from peers that are Cloudflare IPs.
+// Other requests are rejected with 403 Forbidden.
+//
+// Usage:
+//
+//	eu := origin.AllowColos("AMS", "CDG", "FRA", "LHR")
+//	server.Handler = eu(http.DefaultServeMux)
+//	log.Fatal(server.ServeTLS(ln, "", ""))
+func AllowColos(colos ...string) func(http.Handler) http.Handler {
+	return defaultFilter.AllowColos(colos...)
+}
+
+// AllowColos returns middleware that only accepts requests
+// proxied by Cloudflare data centers in colos,
+// trusting the CF-Ray header from peers in the filter's IP ranges.
+func (f *Filter) AllowColos(colos ...string) func(http.Handler) http.Handler {
+	allowed := upperSet(colos)
+	return f.allowHeader(http.StatusForbidden, func(r *http.Request) bool {
+		_, colo, ok := strings.Cut(r.Header.Get("CF-Ray"), "-")
+		return ok && allowed[strings.ToUpper(colo)]
+	})
+}
+
+// AllowCountries returns middleware that only accepts requests
+// from visitors in countries, given by their ISO 3166-1 alpha-2 codes (e.g. "PT", "ES").
+//
+// The country is read from the CF-IPCountry header
+// (which must be enabled for the zone),
+// and only trusted from peers that are Cloudflare IPs.
+// Requests from other countries are rejected with 451 Unavailable For Legal Reasons;
+// requests from other peers with 403 Forbidden.
+func AllowCountries(countries ...string) func(http.Handler) http.Handler {
+	return defaultFilter.AllowCountries(countries...)
+}
+
+// AllowCountries returns middleware that only accepts requests
+// from visitors in countries,
+// trusting the CF-IPCountry header from peers in the filter's IP ranges.
+func (f *Filter) AllowCountries(countries ...string) func(http.Handler) http.Handler {
+	allowed := upperSet(countries)
+	return f.allowHeader(http.StatusUnavailableForLegalReasons, func(r *http.Request) bool {
+		return allowed[strings.ToUpper(r.Header.Get("CF-IPCountry"))]
+	})
+}
+
+// allowHeader rejects requests from untrusted peers with 403,
+// and those that allow rejects with status.
+func (f *Filter) allowHeader(status int, allow func(*http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !f.trustedPeer(r) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			if !allow(r) {
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func upperSet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		set[strings.ToUpper(c)] = true
+	}
+	return set
+}
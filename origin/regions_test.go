@@ -0,0 +1,44 @@
+package origin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilter_AllowColos(t *testing.T) {
+	var f Filter
+	_, n, _ := net.ParseCIDR("192.0.2.0/24")
+	f.SetIPRanges(*n)
+
+	handler := f.AllowColos("lis", "MAD")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	country := f.AllowCountries("PT")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		peer, ray, country string
+		colo, geo          int
+	}{
+		{"192.0.2.1:1234", "1234-LIS", "PT", http.StatusOK, http.StatusOK},
+		{"192.0.2.1:1234", "1234-FRA", "DE", http.StatusForbidden, http.StatusUnavailableForLegalReasons},
+		{"192.0.2.1:1234", "", "", http.StatusForbidden, http.StatusUnavailableForLegalReasons},
+		{"198.51.100.1:1234", "1234-LIS", "PT", http.StatusForbidden, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.peer
+		r.Header.Set("CF-Ray", tt.ray)
+		r.Header.Set("CF-IPCountry", tt.country)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.colo {
+			t.Errorf("AllowColos(%s, %q) = %d, want %d", tt.peer, tt.ray, w.Code, tt.colo)
+		}
+		w = httptest.NewRecorder()
+		country.ServeHTTP(w, r)
+		if w.Code != tt.geo {
+			t.Errorf("AllowCountries(%s, %q) = %d, want %d", tt.peer, tt.country, w.Code, tt.geo)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package origin
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReusePort is a net.ListenConfig.Control function that sets SO_REUSEPORT,
+// allowing several processes to listen on the same address.
+// This enables overlapping restarts: the new server starts listening
+// before the old one stops.
+//
+// SO_REUSEPORT is available on Linux, macOS and the BSDs;
+// on other platforms, ReusePort fails.
+//
+// Usage:
+//
+//	ln, err := origin.ListenWithConfig(ctx, &net.ListenConfig{Control: origin.ReusePort}, "tcp", ":https")
+func ReusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,15 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package origin
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ReusePort is a net.ListenConfig.Control function that sets SO_REUSEPORT.
+//
+// SO_REUSEPORT is not available on this platform, so ReusePort fails.
+func ReusePort(network, address string, c syscall.RawConn) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,23 @@
+package origin
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	lc := net.ListenConfig{Control: ReusePort}
+
+	ln1, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln1.Close()
+
+	ln2, err := lc.Listen(context.Background(), "tcp", ln1.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln2.Close()
+}
@@ -0,0 +1,189 @@
+package origin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrRevoked fails handshakes of clients with a revoked certificate.
+const ErrRevoked stringError = "certificate revoked"
+
+type revocationOption struct {
+	strict bool
+	mutex  sync.Mutex
+	crls   map[string]*cachedCRL
+}
+
+// cachedCRL is the state of a CRL distribution point.
+type cachedCRL struct {
+	crl     *x509.RevocationList // the last good CRL
+	err     error                // the last failure
+	retry   time.Time            // after a failure, when to fetch again
+	backoff time.Duration
+	fetch   chan struct{} // closed when the pending fetch completes
+}
+
+func (o *revocationOption) apply(s *http.Server) {
+	config := s.TLSConfig
+	verifyConnection := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if err := o.verify(cs); err != nil {
+			return err
+		}
+		if verifyConnection != nil {
+			return verifyConnection(cs)
+		}
+		return nil
+	}
+}
+
+// CheckRevocation rejects client certificates (e.g. the origin pull certificate)
+// revoked by their issuer, checking the CRLs at their distribution points.
+//
+// CRLs are fetched during handshakes, and cached until their next update,
+// which adds a network dependency, and latency to some handshakes.
+// If a CRL can't be refreshed, the last good one is used,
+// and fetches are retried with exponential backoff.
+// If strict, handshakes fail when no CRL was ever fetched and verified;
+// otherwise, the failure is logged, and the certificate accepted.
+//
+// Certificates are checked along the chain verified by crypto/tls, or by ClientCAs.
+// Without a verified chain, only the chain sent by the client is checked,
+// which usually excludes the root that issued the first certificate.
+func CheckRevocation(strict bool) ServerOption {
+	return &revocationOption{strict: strict}
+}
+
+func (o *revocationOption) verify(cs tls.ConnectionState) error {
+	chain := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		chain = cs.VerifiedChains[0]
+	}
+
+	// the last certificate has no issuer to check
+	for i := 0; i+1 < len(chain); i++ {
+		err := o.check(chain[i], chain[i+1])
+		if errors.Is(err, ErrRevoked) {
+			return err
+		}
+		if err != nil {
+			if o.strict {
+				return err
+			}
+			log.Println("failed to check certificate revocation:", err)
+		}
+	}
+	return nil
+}
+
+// check checks cert against the CRLs of issuer.
+func (o *revocationOption) check(cert, issuer *x509.Certificate) error {
+	var errs []error
+	for _, url := range cert.CRLDistributionPoints {
+		crl, err := o.crl(url, issuer)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rev := range crl.RevokedCertificateEntries {
+			if rev.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return fmt.Errorf("%w: serial %s", ErrRevoked, cert.SerialNumber)
+			}
+		}
+		// one valid CRL is enough
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// crl returns the CRL at url, signed by issuer.
+// Fetches happen in the background, one at a time for each url;
+// callers with a last good CRL don't wait for them.
+func (o *revocationOption) crl(url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	o.mutex.Lock()
+	c := o.crls[url]
+	if c == nil {
+		if o.crls == nil {
+			o.crls = map[string]*cachedCRL{}
+		}
+		c = &cachedCRL{}
+		o.crls[url] = c
+	}
+
+	now := time.Now()
+	if c.crl != nil && now.Before(c.crl.NextUpdate) {
+		o.mutex.Unlock()
+		return c.crl, nil
+	}
+	if c.fetch == nil && !now.Before(c.retry) {
+		c.fetch = make(chan struct{})
+		go o.fetch(c, url, issuer)
+	}
+	fetch := c.fetch
+	if c.crl == nil && fetch != nil {
+		o.mutex.Unlock()
+		<-fetch
+		o.mutex.Lock()
+	}
+	defer o.mutex.Unlock()
+
+	if c.crl != nil {
+		return c.crl, nil
+	}
+	return nil, c.err
+}
+
+// fetch loads the CRL at url, and updates c.
+func (o *revocationOption) fetch(c *cachedCRL, url string, issuer *x509.Certificate) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	crl, err := loadCRL(ctx, url)
+	if err == nil {
+		err = crl.CheckSignatureFrom(issuer)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if err != nil {
+		// retry after a minute, doubling up to an hour
+		c.backoff = min(max(2*c.backoff, time.Minute), time.Hour)
+		c.retry = time.Now().Add(c.backoff)
+		c.err = err
+	} else {
+		c.crl, c.err, c.backoff = crl, nil, 0
+	}
+	close(c.fetch)
+	c.fetch = nil
+}
+
+func loadCRL(ctx context.Context, url string) (*x509.RevocationList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+
+	der, err := io.ReadAll(io.LimitReader(res.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseRevocationList(der)
+}
@@ -0,0 +1,148 @@
+package origin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckRevocation(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(3), RevocationTime: time.Now()},
+		},
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(crl)
+	}))
+	defer srv.Close()
+
+	leaf := func(serial int64, crlURL string) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			CRLDistributionPoints: []string{crlURL},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &caKey.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		strict bool
+		want   error
+	}{
+		{"valid", leaf(2, srv.URL), true, nil},
+		{"revoked", leaf(3, srv.URL), false, ErrRevoked},
+		{"unavailable", leaf(4, "http://127.0.0.1:1/crl"), false, nil},
+		{"unavailable strict", leaf(4, "http://127.0.0.1:1/crl"), true, errors.New("")},
+	}
+	o := CheckRevocation(false).(*revocationOption)
+	for _, tt := range tests {
+		o.strict = tt.strict
+		err := o.verify(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert, ca}}})
+		if (err == nil) != (tt.want == nil) || tt.want == ErrRevoked && !errors.Is(err, ErrRevoked) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("CRL fetched %d times", fetches)
+	}
+
+	// failures back off, and the last good CRL is used meanwhile
+	var failures int
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	last, err := x509.ParseRevocationList(crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last.NextUpdate = time.Now().Add(-time.Minute)
+	o.crls[down.URL] = &cachedCRL{crl: last}
+	o.strict = true
+	for i := 0; i < 2; i++ {
+		err := o.verify(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf(3, down.URL), ca}}})
+		if !errors.Is(err, ErrRevoked) {
+			t.Errorf("stale: got %v, want %v", err, ErrRevoked)
+		}
+	}
+	o.mutex.Lock()
+	fetch := o.crls[down.URL].fetch
+	o.mutex.Unlock()
+	if fetch != nil {
+		<-fetch
+	}
+	o.verify(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf(3, down.URL), ca}}})
+	if failures != 1 {
+		t.Errorf("CRL fetched %d times", failures)
+	}
+
+	// ClientCAs passes on the chain it verified
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	// in either order
+	for _, options := range [][]ServerOption{
+		{CheckRevocation(true), ClientCAs(pool, false)},
+		{ClientCAs(pool, false), CheckRevocation(true)},
+	} {
+		server := NewServerWithOptions(nil, []tls.Certificate{testCertificate(t)}, options...)
+		for serial, want := range map[int64]bool{2: true, 3: false} {
+			err := server.TLSConfig.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf(serial, srv.URL)}})
+			if got := err == nil; got != want {
+				t.Errorf("ClientCAs serial %d: accepted = %v, want %v (%v)", serial, got, want, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package origin
+
+import "net/http"
+
+// ListenAndServe listens on the TCP address addr (":https" if empty),
+// only accepting connections from Cloudflare IP ranges,
+// and serves handler (or http.DefaultServeMux, if nil) over TLS,
+// with a server created by NewServer.
+//
+// Requests with a Host header that doesn't match SNI are rejected.
+//
+// Usage:
+//
+//	log.Fatal(origin.ListenAndServe("", "cert.pem", "key.pem", "origin-pull-ca.pem", nil))
+func ListenAndServe(addr, certFile, keyFile, pullCAFile string, handler http.Handler) error {
+	return defaultFilter.ListenAndServe(addr, certFile, keyFile, pullCAFile, handler)
+}
+
+// ListenAndServe listens on the TCP address addr (":https" if empty),
+// only accepting connections from the filter's IP ranges,
+// and serves handler (or http.DefaultServeMux, if nil) over TLS,
+// with a server created by NewServer.
+func (f *Filter) ListenAndServe(addr, certFile, keyFile, pullCAFile string, handler http.Handler) error {
+	server, err := NewServer(certFile, keyFile, pullCAFile)
+	if err != nil {
+		return err
+	}
+	if handler != nil {
+		matchingHandler{handler}.apply(server)
+	}
+
+	if addr == "" {
+		addr = ":https"
+	}
+	ln, err := f.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return server.ServeTLS(ln, "", "")
+}
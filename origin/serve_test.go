@@ -0,0 +1,26 @@
+package origin
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilter_ListenAndServe(t *testing.T) {
+	var f Filter
+	f.SetIPRanges(testNets(t)...)
+
+	if err := f.ListenAndServe("127.0.0.1:0", "missing.pem", "missing.pem", "", nil); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v", err)
+	}
+
+	cert := testCertificate(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, cert, certFile, keyFile)
+
+	if err := f.ListenAndServe("127.0.0.1:-1", certFile, keyFile, "", nil); err == nil {
+		t.Error("want error")
+	}
+}
@@ -1,47 +1,199 @@
 package origin
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"io/ioutil"
+	"errors"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+// Errors that fail handshakes, for errors.Is.
 const (
-	errMissingServerName    stringError = "missing server name"
-	errMismatchedServerName stringError = "mismatched server name"
+	ErrMissingServerName    stringError = "missing server name"    // the client sent no SNI
+	ErrMismatchedServerName stringError = "mismatched server name" // no certificate matches the SNI
 )
 
 // NewServer creates a Cloudflare origin http.Server.
 //
 // Filenames containing a certificate and matching private key for the server must be provided.
 // The filename to the origin pull CA certificate is optional.
-func NewServer(certFile, keyFile, pullCAFile string) (*http.Server, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+func NewServer(certFile, keyFile, pullCAFile string, options ...ServerOption) (*http.Server, error) {
+	cert, err := loadCertificate(certFile, keyFile)
 	if err != nil {
 		return nil, err
 	}
 
-	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	var pool *x509.CertPool
+
+	if pullCAFile != "" {
+		pool, err = LoadPullCA(nil, pullCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewServerWithOptions(pool, []tls.Certificate{cert}, options...), nil
+}
+
+// NewServerFromDir creates a Cloudflare origin http.Server
+// serving all certificates found in dir, selected by SNI.
+//
+// Certificates and matching private keys are found as pairs of files
+// named NAME.crt and NAME.key in dir, or as fullchain.pem and privkey.pem
+// in subdirectories of dir (as with certbot's live directory).
+// The filename to the origin pull CA certificate is optional.
+//
+// Certificates are loaded once: restart the server (or create a new one) after renewals.
+func NewServerFromDir(dir, pullCAFile string, options ...ServerOption) (*http.Server, error) {
+	crts, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	chains, err := filepath.Glob(filepath.Join(dir, "*", "fullchain.pem"))
 	if err != nil {
 		return nil, err
 	}
 
+	var pairs [][2]string
+	for _, crt := range crts {
+		key := strings.TrimSuffix(crt, ".crt") + ".key"
+		if _, err := os.Stat(key); err == nil {
+			pairs = append(pairs, [2]string{crt, key})
+		}
+	}
+	for _, chain := range chains {
+		key := filepath.Join(filepath.Dir(chain), "privkey.pem")
+		if _, err := os.Stat(key); err == nil {
+			pairs = append(pairs, [2]string{chain, key})
+		}
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates found in " + dir)
+	}
+
+	certs := make([]tls.Certificate, len(pairs))
+	for i, p := range pairs {
+		certs[i], err = loadCertificate(p[0], p[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var pool *x509.CertPool
 
 	if pullCAFile != "" {
-		pull, err := ioutil.ReadFile(pullCAFile)
+		pool, err = LoadPullCA(nil, pullCAFile)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	return NewServerWithOptions(pool, certs, options...), nil
+}
+
+// loadCertificate loads a certificate and matching private key, and parses its leaf.
+func loadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
 
+// NewServerFromPEM creates a Cloudflare origin http.Server from PEM encoded data,
+// e.g. from environment variables or a secret manager, instead of files.
+//
+// A certificate and matching private key for the server must be provided.
+// The origin pull CA certificate is optional.
+func NewServerFromPEM(certPEM, keyPEM, pullCAPEM []byte, options ...ServerOption) (*http.Server, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var pool *x509.CertPool
+
+	if len(pullCAPEM) > 0 {
 		pool = x509.NewCertPool()
-		pool.AppendCertsFromPEM(pull)
+		if !pool.AppendCertsFromPEM(pullCAPEM) {
+			return nil, errors.New("no origin pull CA certificates found")
+		}
 	}
 
-	return NewServerWithCerts(pool, cert), nil
+	return NewServerWithOptions(pool, []tls.Certificate{cert}, options...), nil
+}
+
+// NewStrictServer creates a Cloudflare origin http.Server that serves handler
+// (or http.DefaultServeMux, if nil), enforcing all checks at once:
+//   - handshakes from peers that aren't Cloudflare IPs are aborted (see FilterPeers),
+//     regardless of the listener used;
+//   - clients must send SNI matching one of the certificates;
+//   - requests with a Host header that doesn't match SNI are rejected;
+//   - if the origin pull CA certificate is provided, clients must authenticate with it.
+//
+// An attacker who knows your hostname can connect to your origin directly, sending the right SNI;
+// only the IP check stops them, so it's best not to leave it to the listener.
+// The IP check runs before any TLS hooks set by options, which can't disable it.
+// Replacing the server's Handler afterwards disables the Host check.
+func NewStrictServer(handler http.Handler, pullCA *x509.CertPool, cert []tls.Certificate, options ...ServerOption) *http.Server {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	// set the handler first, so other options can wrap it;
+	// filter peers last, so no other TLS hook runs before the check
+	options = append([]ServerOption{matchingHandler{handler}}, options...)
+	options = append(options, FilterPeers(nil))
+	return NewServerWithOptions(pullCA, cert, options...)
+}
+
+type matchingHandler struct{ handler http.Handler }
+
+func (o matchingHandler) apply(s *http.Server) {
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveMatching(o.handler, w, r)
+	})
+}
+
+// LoadPullCA loads origin pull CA certificates from PEM files,
+// and adds them to a copy of pool (or to a new pool, if nil).
+//
+// Trusting more than one CA allows a seamless transition
+// when Cloudflare rotates its origin pull certificate.
+func LoadPullCA(pool *x509.CertPool, pullCAFile ...string) (*x509.CertPool, error) {
+	if pool == nil {
+		pool = x509.NewCertPool()
+	} else {
+		pool = pool.Clone()
+	}
+
+	for _, name := range pullCAFile {
+		pull, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pull) {
+			return nil, errors.New("no certificates found in " + name)
+		}
+	}
+	return pool, nil
 }
 
 // NewServerWithCerts creates a Cloudflare origin http.Server from loaded certificates.
@@ -49,23 +201,59 @@ func NewServer(certFile, keyFile, pullCAFile string) (*http.Server, error) {
 // The origin pull CA certificate is optional.
 // At least one server certificate must be provided.
 func NewServerWithCerts(pullCA *x509.CertPool, cert ...tls.Certificate) *http.Server {
+	return NewServerWithOptions(pullCA, cert)
+}
+
+// NewServerWithOptions creates a Cloudflare origin http.Server from loaded certificates,
+// customized by options.
+//
+// The origin pull CA certificate is optional.
+// At least one server certificate must be provided, unless the GetCertificate option is used.
+func NewServerWithOptions(pullCA *x509.CertPool, cert []tls.Certificate, options ...ServerOption) *http.Server {
+	return NewServerWithConfig(nil, pullCA, cert, options...)
+}
+
+// NewServerWithConfig is like NewServerWithOptions,
+// but builds on a copy of config (e.g. with custom cipher suites, or a KeyLogWriter).
+//
+// These fields are overwritten: MinVersion (raised to TLS 1.3), GetCertificate,
+// and if the origin pull CA certificate is provided, ClientCAs and ClientAuth.
+// Other fields are left as in config.
+func NewServerWithConfig(config *tls.Config, pullCA *x509.CertPool, cert []tls.Certificate, options ...ServerOption) *http.Server {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+
 	// require TLS 1.3
-	config := &tls.Config{MinVersion: tls.VersionTLS13}
+	if config.MinVersion < tls.VersionTLS13 {
+		config.MinVersion = tls.VersionTLS13
+	}
 
 	config.GetCertificate = func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		// require SNI
 		if info.ServerName == "" {
-			return nil, errMissingServerName
+			metrics.missingSNI.Add(1)
+			return nil, ErrMissingServerName
 		}
 
-		// find matching certificate
+		// find the matching certificate the client prefers
+		var best *tls.Certificate
+		var bestRank int
 		for i := range cert {
 			if err := info.SupportsCertificate(&cert[i]); err == nil {
-				return &cert[i], nil
+				if rank := schemeRank(info, &cert[i]); best == nil || rank < bestRank {
+					best, bestRank = &cert[i], rank
+				}
 			}
 		}
+		if best != nil {
+			return best, nil
+		}
 
-		return nil, errMismatchedServerName
+		metrics.sniMismatch.Add(1)
+		return nil, ErrMismatchedServerName
 	}
 
 	// validate client certificate against origin pull certificate
@@ -75,7 +263,7 @@ func NewServerWithCerts(pullCA *x509.CertPool, cert ...tls.Certificate) *http.Se
 	}
 
 	// default port, reasonably large default timeouts
-	return &http.Server{
+	server := &http.Server{
 		TLSConfig:         config,
 		ReadHeaderTimeout: 5 * time.Second,
 		ReadTimeout:       1 * time.Minute,
@@ -83,6 +271,64 @@ func NewServerWithCerts(pullCA *x509.CertPool, cert ...tls.Certificate) *http.Se
 		IdleTimeout:       10 * time.Minute,
 		Handler:           http.HandlerFunc(serveMux),
 	}
+
+	// remember the origin pull CA, for IsOriginPullVerified
+	if pullCA != nil {
+		server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, pullCAKey{}, pullCA)
+		}
+	}
+
+	// ClientCAs verifies the client certificates requested by other options,
+	// and passes on the verified chains, so it's applied last
+	var last []ServerOption
+	for _, o := range options {
+		if _, ok := o.(clientCAsOption); ok {
+			last = append(last, o)
+			continue
+		}
+		o.apply(server)
+	}
+	for _, o := range last {
+		o.apply(server)
+	}
+	return server
+}
+
+// schemeRank is the position, in the client's preferences,
+// of the first signature scheme cert can sign with.
+// With dual (e.g. ECDSA and RSA) certificates, the lowest rank is best.
+func schemeRank(info *tls.ClientHelloInfo, cert *tls.Certificate) int {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return len(info.SignatureSchemes)
+	}
+
+	var schemes []tls.SignatureScheme
+	switch pub := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			schemes = []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}
+		case elliptic.P384():
+			schemes = []tls.SignatureScheme{tls.ECDSAWithP384AndSHA384}
+		case elliptic.P521():
+			schemes = []tls.SignatureScheme{tls.ECDSAWithP521AndSHA512}
+		}
+	case ed25519.PublicKey:
+		schemes = []tls.SignatureScheme{tls.Ed25519}
+	case *rsa.PublicKey:
+		schemes = []tls.SignatureScheme{tls.PSSWithSHA256, tls.PSSWithSHA384, tls.PSSWithSHA512}
+	}
+
+	for i, s := range info.SignatureSchemes {
+		for _, c := range schemes {
+			if s == c {
+				return i
+			}
+		}
+	}
+	return len(info.SignatureSchemes)
 }
 
 // MatchServerNameHost checks if SNI matches the Host header for a TLS http.Request.
@@ -97,10 +343,36 @@ func MatchHostServerName(r *http.Request) bool {
 	return r.TLS.ServerName == host
 }
 
+// IsOriginPullVerified reports whether the client of a TLS http.Request
+// authenticated with a certificate issued by the origin pull CA
+// (i.e. the request came from Cloudflare, through authenticated origin pulls).
+//
+// It's always false if the server was created without an origin pull CA,
+// or if ClientAuthPolicy didn't require a certificate from the peer.
+// Certificates are verified against the origin pull CA only,
+// so other CAs (e.g. from ClientCAs, or the system roots) don't count.
+func IsOriginPullVerified(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	pullCA, ok := r.Context().Value(pullCAKey{}).(*x509.CertPool)
+	if !ok {
+		return false
+	}
+	_, err := verifyClientCert(r.TLS.PeerCertificates, []*x509.CertPool{pullCA})
+	return err == nil
+}
+
 func serveMux(w http.ResponseWriter, r *http.Request) {
-	if MatchHostServerName(r) {
-		http.DefaultServeMux.ServeHTTP(w, r)
+	serveMatching(http.DefaultServeMux, w, r)
+}
+
+func serveMatching(handler http.Handler, w http.ResponseWriter, r *http.Request) {
+	// without SNI (see DefaultCertificate) there's nothing to match
+	if MatchHostServerName(r) || r.TLS.ServerName == "" {
+		handler.ServeHTTP(w, r)
 	} else {
-		w.WriteHeader(http.StatusForbidden)
+		metrics.hostMismatch.Add(1)
+		serveMismatch(w, r)
 	}
 }
@@ -0,0 +1,291 @@
+package origin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	return testCertificateFor(t, "example.com")
+}
+
+func testCertificateFor(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestNewServerFromPEM(t *testing.T) {
+	cert := testCertificate(t)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+
+	server, err := NewServerFromPEM(certPEM, keyPEM, certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("got %v", server.TLSConfig.ClientAuth)
+	}
+
+	if _, err := NewServerFromPEM(certPEM, keyPEM, []byte("garbage")); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestNewServerWithConfig(t *testing.T) {
+	base := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519},
+	}
+	server := NewServerWithConfig(base, nil, []tls.Certificate{testCertificate(t)})
+
+	config := server.TLSConfig
+	if config == base || config.MinVersion != tls.VersionTLS13 || config.GetCertificate == nil ||
+		len(config.CurvePreferences) != 1 {
+		t.Errorf("got %+v", config)
+	}
+	if base.MinVersion != tls.VersionTLS12 || base.GetCertificate != nil {
+		t.Error("base config modified")
+	}
+}
+
+func TestNewServer_dualCerts(t *testing.T) {
+	ecdsaCert := testCertificate(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaCert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	server := NewServerWithCerts(nil, rsaCert, ecdsaCert)
+	for scheme, want := range map[tls.SignatureScheme]*tls.Certificate{
+		tls.PSSWithSHA256:          &rsaCert,
+		tls.ECDSAWithP256AndSHA256: &ecdsaCert,
+	} {
+		info := &tls.ClientHelloInfo{
+			ServerName:        "example.com",
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{scheme, tls.PSSWithSHA256, tls.ECDSAWithP256AndSHA256},
+		}
+		got, err := server.TLSConfig.GetCertificate(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.PrivateKey != want.PrivateKey {
+			t.Errorf("%v: got the wrong certificate", scheme)
+		}
+	}
+}
+
+func TestNewStrictServer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	server := NewStrictServer(handler, nil, []tls.Certificate{testCertificate(t)})
+
+	if server.TLSConfig.GetConfigForClient == nil {
+		t.Error("peers aren't filtered")
+	}
+	for host, want := range map[string]int{
+		"example.com":      http.StatusOK,
+		"example.com:443":  http.StatusOK,
+		"attacker.example": http.StatusForbidden,
+	} {
+		r := httptest.NewRequest("GET", "https://"+host+"/", nil)
+		r.TLS = &tls.ConnectionState{ServerName: "example.com"}
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%s: got %d, want %d", host, w.Code, want)
+		}
+	}
+}
+
+func TestNewStrictServer_options(t *testing.T) {
+	cert := testCertificate(t)
+
+	server := NewStrictServer(nil, nil, []tls.Certificate{cert},
+		RotateSessionTicketKeys(nil, time.Hour),
+		ClientAuthPolicy(func(net.Addr) tls.ClientAuthType { return tls.NoClientCert }),
+		// an option that ignores any earlier GetConfigForClient
+		serverOptionFunc(func(s *http.Server) {
+			s.TLSConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) { return nil, nil }
+		}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+
+	// loopback isn't a Cloudflare IP
+	c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err == nil {
+		c.Close()
+		t.Error("handshake succeeded")
+	}
+}
+
+type serverOptionFunc func(*http.Server)
+
+func (o serverOptionFunc) apply(s *http.Server) { o(s) }
+
+func TestNewServer_missingServerName(t *testing.T) {
+	server := NewServerWithCerts(nil, testCertificate(t))
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server.TLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+
+	// without SNI, the handshake fails before any certificate is sent
+	var leaked bool
+	c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			leaked = len(cs.PeerCertificates) > 0
+			return nil
+		},
+	})
+	if err == nil {
+		c.Close()
+		t.Error("want error")
+	}
+	if leaked {
+		t.Error("certificate leaked")
+	}
+}
+
+func TestNewServerFromDir(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewServerFromDir(dir, ""); err == nil {
+		t.Error("want error")
+	}
+
+	writeCertificate(t, testCertificateFor(t, "a.example.com"),
+		filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"))
+	if err := os.Mkdir(filepath.Join(dir, "b.example.com"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeCertificate(t, testCertificateFor(t, "b.example.com"),
+		filepath.Join(dir, "b.example.com", "fullchain.pem"), filepath.Join(dir, "b.example.com", "privkey.pem"))
+	// no key: ignored
+	os.WriteFile(filepath.Join(dir, "c.crt"), nil, 0600)
+
+	server, err := NewServerFromDir(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		cert, err := server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:        name,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf == nil || cert.Leaf.DNSNames[0] != name {
+			t.Errorf("%s: got %v", name, cert.Leaf)
+		}
+	}
+}
+
+func TestLoadPullCA(t *testing.T) {
+	dir := t.TempDir()
+	a, b := testCertificate(t), testCertificate(t)
+	writeCertificate(t, a, filepath.Join(dir, "a.pem"), filepath.Join(dir, "a.key"))
+	writeCertificate(t, b, filepath.Join(dir, "b.pem"), filepath.Join(dir, "b.key"))
+	leafA, _ := x509.ParseCertificate(a.Certificate[0])
+	leafB, _ := x509.ParseCertificate(b.Certificate[0])
+
+	base := x509.NewCertPool()
+	base.AddCert(leafA)
+	pool, err := LoadPullCA(base, filepath.Join(dir, "b.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := x509.NewCertPool()
+	want.AddCert(leafA)
+	want.AddCert(leafB)
+	if !pool.Equal(want) {
+		t.Error("want both certificates")
+	}
+	if base.Equal(want) {
+		t.Error("pool modified")
+	}
+
+	pool, err = LoadPullCA(nil, filepath.Join(dir, "a.pem"), filepath.Join(dir, "b.pem"))
+	if err != nil || !pool.Equal(want) {
+		t.Errorf("nil pool: got %v", err)
+	}
+
+	// a missing file, or a file without certificates, fails
+	for _, name := range []string{"c.pem", "a.key"} {
+		if _, err := LoadPullCA(nil, filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+// writeCertificate writes cert and its private key as PEM files.
+func writeCertificate(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
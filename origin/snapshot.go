@@ -0,0 +1,70 @@
+package origin
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// LoadSnapshot loads the filter's IP ranges from a snapshot file.
+// See ParseSnapshot for the format.
+//
+// Pinning the ranges to a snapshot, checked in alongside the deployment,
+// makes the ranges trusted deterministic and auditable.
+func (f *Filter) LoadSnapshot(name string, refresh bool) error {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return f.ParseSnapshot(string(buf), refresh)
+}
+
+// ParseSnapshot sets the filter's IP ranges from a snapshot:
+// CIDRs separated by newlines, spaces or commas, with # starting a comment.
+// The concatenation of Cloudflare's ips-v4 and ips-v6 lists is a valid snapshot.
+//
+// The snapshot can come from an environment variable, or be embedded in the binary:
+//
+//	//go:embed cloudflare-ips.txt
+//	var snapshot string
+//
+//	err := filter.ParseSnapshot(snapshot, false)
+//
+// If refresh is false, the ranges are pinned, and never fetched (as with SetIPRanges).
+// Otherwise, the snapshot is used until the ranges are fetched, and if fetching fails.
+// Either way, ExtraRanges are accepted in addition to the snapshot.
+func (f *Filter) ParseSnapshot(snapshot string, refresh bool) error {
+	var nets []net.IPNet
+	for _, line := range strings.Split(snapshot, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		for _, s := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		}) {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return err
+			}
+			nets = append(nets, *n)
+		}
+	}
+	if len(nets) == 0 {
+		return ErrNoRanges
+	}
+
+	if !refresh {
+		f.SetIPRanges(append(nets, f.ExtraRanges...)...)
+		return nil
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.ips.Store(newIPRanges(append(nets, f.ExtraRanges...)))
+	f.updated.Store(time.Now())
+	return nil
+}
+
+// ErrNoRanges is returned when a source of IP ranges has none.
+const ErrNoRanges stringError = "no IP ranges found"
@@ -0,0 +1,40 @@
+package origin
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFilter_ParseSnapshot(t *testing.T) {
+	var f Filter
+	err := f.ParseSnapshot("# pinned 2024-01-01\n192.0.2.0/24, 198.51.100.0/24\r\n2001:db8::/32 # docs\n", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips, _ := f.ips.Load().(*ipRanges); ips.count != 3 || !f.static {
+		t.Errorf("got %+v", ips)
+	}
+
+	if err := f.ParseSnapshot("# empty", false); err != ErrNoRanges {
+		t.Errorf("got %v", err)
+	}
+	if err := f.ParseSnapshot("192.0.2.0", false); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestFilter_ParseSnapshot_extraRanges(t *testing.T) {
+	_, extra, _ := net.ParseCIDR("203.0.113.0/24")
+	for _, refresh := range []bool{false, true} {
+		f := Filter{ExtraRanges: []net.IPNet{*extra}}
+		if err := f.ParseSnapshot("192.0.2.0/24", refresh); err != nil {
+			t.Fatal(err)
+		}
+		ips, _ := f.ips.Load().(*ipRanges)
+		for _, ip := range []string{"192.0.2.1", "203.0.113.1"} {
+			if !ips.contains(net.ParseIP(ip)) {
+				t.Errorf("refresh = %v: %s not accepted", refresh, ip)
+			}
+		}
+	}
+}
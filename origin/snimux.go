@@ -0,0 +1,60 @@
+package origin
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NewSNIMux returns a handler that dispatches requests to handlers by server name,
+// making the origin a small virtual host server.
+//
+// The server name is the SNI of TLS requests (or the Host header, without SNI),
+// matched case insensitively against the keys of handlers,
+// which can also be wildcards (e.g. "*.example.com", matching a single label).
+// Requests whose Host header doesn't match SNI are rejected with 421 Misdirected Request,
+// and those for unknown names with 404 Not Found.
+//
+// Usage:
+//
+//	server.Handler = origin.NewSNIMux(map[string]http.Handler{
+//		"example.com":     site,
+//		"api.example.com": api,
+//	})
+func NewSNIMux(handlers map[string]http.Handler) http.Handler {
+	mux := make(map[string]http.Handler, len(handlers))
+	for name, h := range handlers {
+		mux[strings.ToLower(name)] = h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			if !MatchHostServerName(r) {
+				metrics.hostMismatch.Add(1)
+				http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+				return
+			}
+			name = r.TLS.ServerName
+		} else {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			name = host
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+		h, ok := mux[name]
+		if !ok {
+			if _, parent, found := strings.Cut(name, "."); found {
+				h, ok = mux["*."+parent]
+			}
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
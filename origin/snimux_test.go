@@ -0,0 +1,43 @@
+package origin
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewSNIMux(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, name) })
+	}
+	mux := NewSNIMux(map[string]http.Handler{
+		"Example.com":     handler("site"),
+		"*.example.com":   handler("wildcard"),
+		"api.example.com": handler("api"),
+	})
+
+	tests := []struct {
+		sni, host string
+		code      int
+		body      string
+	}{
+		{"example.com", "example.com", http.StatusOK, "site"},
+		{"api.example.com", "api.example.com:443", http.StatusOK, "api"},
+		{"www.example.com", "www.example.com", http.StatusOK, "wildcard"},
+		{"", "EXAMPLE.COM", http.StatusOK, "site"},
+		{"example.com", "api.example.com", http.StatusMisdirectedRequest, ""},
+		{"example.org", "example.org", http.StatusNotFound, ""},
+		{"a.b.example.com", "a.b.example.com", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "https://"+tt.host+"/", nil)
+		r.TLS = &tls.ConnectionState{ServerName: tt.sni}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.code || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s, %s: got %d %q", tt.sni, tt.host, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package origin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Session tickets allow clients to resume TLS sessions without a full handshake.
+//
+// By default, crypto/tls encrypts tickets with ephemeral keys, which it rotates automatically.
+// This is the safest choice, but tickets are invalidated whenever the server restarts,
+// and aren't shared by different instances of the server.
+//
+// Persistent keys allow resumption across restarts and instances.
+// The downside is that anyone who learns a key can decrypt the tickets it encrypted,
+// and impersonate the server to clients resuming those sessions.
+// Keys (or the secret they're derived from) should be protected as well as the server's private key,
+// and rotated often.
+
+type sessionTicketKeys [][32]byte
+
+func (o sessionTicketKeys) apply(s *http.Server) {
+	s.TLSConfig.SetSessionTicketKeys(o)
+}
+
+// SessionTicketKeys sets the keys used to encrypt and decrypt session tickets.
+// The first key is used for new tickets; all keys are used to decrypt tickets.
+//
+// This disables the automatic rotation of keys by crypto/tls.
+func SessionTicketKeys(keys ...[32]byte) ServerOption {
+	return sessionTicketKeys(keys)
+}
+
+type rotateSessionTicketKeys struct {
+	secret []byte
+	period time.Duration
+}
+
+type ticketEpoch struct {
+	epoch int64
+	keys  [][32]byte
+}
+
+func (o rotateSessionTicketKeys) apply(s *http.Server) {
+	secret := o.secret
+	if secret == nil {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			// keep the automatic rotation of crypto/tls
+			log.Println("failed to generate session ticket secret:", err)
+			return
+		}
+	}
+
+	// http.Server clones its TLSConfig before serving:
+	// handshake with the original, so it sees the rotated keys
+	config := s.TLSConfig
+	period := int64(o.period)
+	var current atomic.Pointer[ticketEpoch]
+	rotate := func() [][32]byte {
+		epoch := time.Now().UnixNano() / period
+		if e := current.Load(); e != nil && e.epoch == epoch {
+			return e.keys
+		}
+		keys := [][32]byte{
+			ticketKey(secret, epoch),
+			ticketKey(secret, epoch-1),
+		}
+		config.SetSessionTicketKeys(keys)
+		current.Store(&ticketEpoch{epoch, keys})
+		return keys
+	}
+	rotate()
+
+	// keys are rotated during handshakes, so nothing outlives the server
+	getConfigForClient := config.GetConfigForClient
+	config.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+		keys := rotate()
+		if getConfigForClient != nil {
+			c, err := getConfigForClient(info)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				c.SetSessionTicketKeys(keys)
+				return c, nil
+			}
+		}
+		return config, nil
+	}
+}
+
+// RotateSessionTicketKeys derives session ticket keys from secret,
+// rotating them every period.
+//
+// Keys are derived from the secret and the current time,
+// so servers sharing a secret rotate the same keys in lockstep,
+// and tickets survive restarts.
+// Tickets remain valid for at least one period and at most two.
+// A nil secret generates a random one, so keys are ephemeral.
+//
+// Keys are rotated as handshakes need them, so no goroutine outlives the server.
+func RotateSessionTicketKeys(secret []byte, period time.Duration) ServerOption {
+	if period <= 0 {
+		period = 24 * time.Hour
+	}
+	return rotateSessionTicketKeys{secret, period}
+}
+
+func ticketKey(secret []byte, epoch int64) (key [32]byte) {
+	mac := hmac.New(sha256.New, secret)
+	binary.Write(mac, binary.BigEndian, epoch)
+	mac.Sum(key[:0])
+	return key
+}
@@ -0,0 +1,55 @@
+package origin
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRotateSessionTicketKeys(t *testing.T) {
+	cert := testCertificate(t)
+	secret := []byte("secret")
+
+	for cidr, want := range map[string]bool{"127.0.0.0/8": true, "192.0.2.0/24": false} {
+		var f Filter
+		_, n, _ := net.ParseCIDR(cidr)
+		f.SetIPRanges(*n)
+
+		for _, options := range [][]ServerOption{
+			{FilterPeers(&f), RotateSessionTicketKeys(secret, time.Hour)},
+			{RotateSessionTicketKeys(secret, time.Hour), FilterPeers(&f)},
+		} {
+			server := NewServerWithOptions(nil, []tls.Certificate{cert}, options...)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.ServeTLS(ln, "", "")
+
+			client := http.Client{Transport: &http.Transport{
+				DisableKeepAlives: true,
+				TLSClientConfig: &tls.Config{
+					ServerName:         "example.com",
+					InsecureSkipVerify: true,
+					ClientSessionCache: tls.NewLRUClientSessionCache(1),
+				},
+			}}
+			for i := 0; i < 2; i++ {
+				res, err := client.Get("https://" + ln.Addr().String())
+				if got := err == nil; got != want {
+					t.Errorf("%s: handshake succeeded = %v, want %v (%v)", cidr, got, want, err)
+				}
+				if err != nil {
+					break
+				}
+				if got := res.TLS.DidResume; got != (i > 0) {
+					t.Errorf("%s: resumed = %v", cidr, got)
+				}
+				res.Body.Close()
+			}
+			server.Close()
+		}
+	}
+}